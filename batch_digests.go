@@ -0,0 +1,201 @@
+package grip
+
+import (
+	"encoding/base64"
+	"log"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//CAPBATCHDIGS the node answers CheckDigs, and acknowledges the
+//records it asked for with AckDigs
+const CAPBATCHDIGS string = "batch-digests"
+
+//MAXBATCHDIGS the most digests in one CheckDigs or AckDigs
+const MAXBATCHDIGS int = 256
+
+//MAXBATCHPENDING is MAXPENDING for a node that batches.  It is a
+//few CheckDigs, so the next is on its way while records for the
+//last are still being sent.
+const MAXBATCHPENDING int = 4 * MAXBATCHDIGS
+
+//CheckDigs is CheckDig for many digests
+type CheckDigs struct {
+	Digs [][]byte
+}
+
+//RespDigs answers a CheckDigs.  Bit i of Have is set if the
+//node already has Digs[i], the rest should be sent.
+type RespDigs struct {
+	Digs [][]byte
+	Have []byte
+}
+
+//AckDigs acknowledges every record in Digs
+type AckDigs struct {
+	Digs [][]byte
+}
+
+//sendDigs is a RespDigs for the write routine to act on
+type sendDigs RespDigs
+
+//HasDig true if bit i of Have is set
+func (r *RespDigs) HasDig(i int) bool {
+	return i/8 < len(r.Have) && r.Have[i/8]&(1<<uint(i%8)) != 0
+}
+
+//digBatch the records this node asked for in a RespDigs that
+//have not come yet, and the acknowledgements waiting to go
+type digBatch struct {
+	wanted map[string]bool
+	acks   [][]byte
+}
+
+func newDigBatch() digBatch {
+	var b digBatch
+	b.wanted = make(map[string]bool)
+	return b
+}
+
+//sendLimit how many SendData to look at each time
+func (ctrl *ConnectionController) sendLimit() int {
+	if ctrl.HasFeature(CAPBATCHDIGS) {
+		return MAXBATCHPENDING
+	}
+	return MAXSEND
+}
+
+//sendCheckDigs offers sl MAXBATCHDIGS at a time, leaving out
+//what is already pending.  It stops at MAXBATCHPENDING.
+func (ctrl *ConnectionController) sendCheckDigs(sl []gripdata.SendData) error {
+	var pl []gripdata.SendData
+	for _, v := range sl {
+		if ctrl.IsDone() {
+			return griperrors.ConnectionClosed
+		}
+		if ctrl.Pending.Count()+len(pl) >= MAXBATCHPENDING {
+			break
+		}
+		if _, ok := ctrl.Pending.Get(base64.StdEncoding.EncodeToString(v.Dig)); !ok {
+			pl = append(pl, v)
+		}
+		if len(pl) == MAXBATCHDIGS {
+			err := ctrl.sendCheckDigList(pl)
+			if err != nil {
+				return err
+			}
+			pl = nil
+		}
+	}
+	return ctrl.sendCheckDigList(pl)
+}
+
+func (ctrl *ConnectionController) sendCheckDigList(pl []gripdata.SendData) error {
+	if len(pl) == 0 {
+		return nil
+	}
+	var c CheckDigs
+	for _, v := range pl {
+		c.Digs = append(c.Digs, v.Dig)
+	}
+	err := ctrl.C.Send(c)
+	if err != nil {
+		return err
+	}
+	for _, v := range pl {
+		ctrl.Pending.Set(base64.StdEncoding.EncodeToString(v.Dig), v)
+	}
+	return nil
+}
+
+//sendWanted sends the records the other node does not have, and
+//forgets the ones it does
+func (ctrl *ConnectionController) sendWanted(v RespDigs) error {
+	for i, d := range v.Digs {
+		var err error
+		if v.HasDig(i) {
+			err = ctrl.deleteSendDataOrFileTransfer(d)
+		} else {
+			err = ctrl.sendSendData(d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkDigs answers a CheckDigs and remembers what we asked for
+func (ctrl *ConnectionController) checkDigs(v CheckDigs) {
+	if len(v.Digs) > MAXBATCHDIGS {
+		v.Digs = v.Digs[:MAXBATCHDIGS]
+	}
+	var r RespDigs
+	r.Digs = v.Digs
+	r.Have = make([]byte, (len(v.Digs)+7)/8)
+	for i, d := range v.Digs {
+		ctrl.seen(d)
+		if ctrl.DB.GetDigestData(d) != nil {
+			r.Have[i/8] |= 1 << uint(i%8)
+		} else {
+			ctrl.digs.wanted[base64.StdEncoding.EncodeToString(d)] = true
+		}
+	}
+	ctrl.queueSend(r)
+}
+
+func (ctrl *ConnectionController) ackDigs(v AckDigs) {
+	for _, d := range v.Digs {
+		ctrl.seen(d)
+		err := ctrl.deleteSendDataOrFileTransfer(d)
+		if err != nil {
+			log.Printf("Failed to delete SendData! %s", err)
+		}
+	}
+}
+
+//unwant the record is answered on its own, with a RejectDig or
+//once the file data for a ContextFile is here
+func (ctrl *ConnectionController) unwant(dig []byte) {
+	delete(ctrl.digs.wanted, base64.StdEncoding.EncodeToString(dig))
+	if len(ctrl.digs.wanted) == 0 {
+		ctrl.flushAcks()
+	}
+}
+
+//ackRecord acknowledges a record we asked for in a batch with the
+//rest of them.  They are sent once all have come, MAXBATCHDIGS
+//are waiting, or the other node sends something else.
+func (ctrl *ConnectionController) ackRecord(dig []byte) {
+	ds := base64.StdEncoding.EncodeToString(dig)
+	if !ctrl.digs.wanted[ds] {
+		ctrl.queueSend(AckDig{Dig: dig})
+		return
+	}
+	delete(ctrl.digs.wanted, ds)
+	ctrl.digs.acks = append(ctrl.digs.acks, dig)
+	if len(ctrl.digs.wanted) == 0 || len(ctrl.digs.acks) >= MAXBATCHDIGS {
+		ctrl.flushAcks()
+	}
+}
+
+func (ctrl *ConnectionController) flushAcks() {
+	if len(ctrl.digs.acks) > 0 {
+		ctrl.queueSend(AckDigs{Digs: ctrl.digs.acks})
+		ctrl.digs.acks = nil
+	}
+}
+
+//carriesRecords true for the messages records arrive in.  Any
+//other message means the other node is not sending the records
+//we asked for right now, so the acknowledgements can go.
+func carriesRecords(d interface{}) bool {
+	switch d.(type) {
+	case Compressed, *gripdata.Node, *gripdata.AssociateNodeAccountKey, *gripdata.UseShareNodeKey,
+		*gripdata.ShareNodeInfo, *gripdata.Context, *gripdata.ContextRequest,
+		*gripdata.ContextResponse, *gripdata.ContextFile, *gripdata.ContextFileTransfer:
+		return true
+	}
+	return false
+}
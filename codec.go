@@ -0,0 +1,307 @@
+package grip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+
+	"github.com/wyathan/grip/griperrors"
+)
+
+//WIREVERSION is the version of the wire codec.  It is the
+//first byte of every encoded message.
+const WIREVERSION byte = 1
+
+//MAXDECODEDEPTH is how deeply nested pointers and slices
+//may be in a message we decode
+const MAXDECODEDEPTH int = 8
+
+//wireType is a type that can be sent on a stream connection
+type wireType struct {
+	Tag  uint16
+	Name string
+	Type reflect.Type
+}
+
+var wireTags = make(map[uint16]*wireType)
+var wireTypes = make(map[reflect.Type]*wireType)
+
+//RegisterWireType gives a message type a stable tag and name.
+//Tags must never be reused for a different type.  Register the
+//value type for protocol messages and the pointer type for
+//records, the same way readSwitch expects them.
+func RegisterWireType(tag uint16, name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	if _, ok := wireTags[tag]; ok {
+		panic("Wire tag registered twice: " + name)
+	}
+	if _, ok := wireTypes[t]; ok {
+		panic("Wire type registered twice: " + name)
+	}
+	wt := &wireType{Tag: tag, Name: name, Type: t}
+	wireTags[tag] = wt
+	wireTypes[t] = wt
+}
+
+//WireTypeName the registered name for v's type
+func WireTypeName(v interface{}) string {
+	wt, ok := wireTypes[reflect.TypeOf(v)]
+	if !ok {
+		return reflect.TypeOf(v).String()
+	}
+	return wt.Name
+}
+
+//EncodeMessage encodes a registered message as the version
+//byte, the type tag, then the exported fields in order
+func EncodeMessage(d interface{}) ([]byte, error) {
+	wt, ok := wireTypes[reflect.TypeOf(d)]
+	if !ok {
+		return nil, griperrors.UnknownMessageType
+	}
+	var b bytes.Buffer
+	b.WriteByte(WIREVERSION)
+	var t [2]byte
+	binary.BigEndian.PutUint16(t[:], wt.Tag)
+	b.Write(t[:])
+	err := encodeValue(&b, reflect.ValueOf(d))
+	if err != nil {
+		return nil, err
+	}
+	if b.Len() > MAXFRAMESIZE {
+		return nil, griperrors.FrameTooLarge
+	}
+	return b.Bytes(), nil
+}
+
+//DecodeMessage decodes a message made by EncodeMessage
+func DecodeMessage(b []byte) (interface{}, error) {
+	if len(b) > MAXFRAMESIZE {
+		return nil, griperrors.FrameTooLarge
+	}
+	if len(b) < 3 {
+		return nil, griperrors.MalformedMessage
+	}
+	if b[0] != WIREVERSION {
+		return nil, griperrors.UnsupportedWireVersion
+	}
+	wt, ok := wireTags[binary.BigEndian.Uint16(b[1:3])]
+	if !ok {
+		return nil, griperrors.UnknownMessageType
+	}
+	d := decoder{b: b[3:]}
+	v := reflect.New(wt.Type).Elem()
+	err := d.decodeValue(v, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.b) != 0 {
+		return nil, griperrors.MalformedMessage
+	}
+	return v.Interface(), nil
+}
+
+func encodeUvarint(b *bytes.Buffer, u uint64) {
+	var t [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(t[:], u)
+	b.Write(t[:n])
+}
+
+func encodeValue(b *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var t [binary.MaxVarintLen64]byte
+		n := binary.PutVarint(t[:], v.Int())
+		b.Write(t[:n])
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		encodeUvarint(b, v.Uint())
+	case reflect.String:
+		encodeUvarint(b, uint64(v.Len()))
+		b.WriteString(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeUvarint(b, uint64(v.Len()))
+			b.Write(v.Bytes())
+			return nil
+		}
+		encodeUvarint(b, uint64(v.Len()))
+		for c := 0; c < v.Len(); c++ {
+			err := encodeValue(b, v.Index(c))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			b.WriteByte(0)
+			return nil
+		}
+		b.WriteByte(1)
+		return encodeValue(b, v.Elem())
+	case reflect.Struct:
+		for c := 0; c < v.NumField(); c++ {
+			if v.Type().Field(c).PkgPath != "" {
+				continue //Not exported
+			}
+			err := encodeValue(b, v.Field(c))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return griperrors.UnsupportedFieldType
+	}
+	return nil
+}
+
+//decoder reads values from an encoded message.  Every length is
+//checked against the bytes left so a bad message cannot make us
+//allocate more than the frame size.
+type decoder struct {
+	b []byte
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	u, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, griperrors.MalformedMessage
+	}
+	d.b = d.b[n:]
+	return u, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	i, n := binary.Varint(d.b)
+	if n <= 0 {
+		return 0, griperrors.MalformedMessage
+	}
+	d.b = d.b[n:]
+	return i, nil
+}
+
+func (d *decoder) length() (int, error) {
+	l, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if l > uint64(len(d.b)) {
+		return 0, griperrors.MalformedMessage
+	}
+	return int(l), nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	l, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	s := d.b[:l:l]
+	d.b = d.b[l:]
+	return s, nil
+}
+
+func (d *decoder) flag() (bool, error) {
+	if len(d.b) < 1 || d.b[0] > 1 {
+		return false, griperrors.MalformedMessage
+	}
+	f := d.b[0] == 1
+	d.b = d.b[1:]
+	return f, nil
+}
+
+func (d *decoder) decodeValue(v reflect.Value, depth int) error {
+	if depth > MAXDECODEDEPTH {
+		return griperrors.MalformedMessage
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		f, err := d.flag()
+		if err != nil {
+			return err
+		}
+		v.SetBool(f)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := d.varint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return griperrors.MalformedMessage
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(u) {
+			return griperrors.MalformedMessage
+		}
+		v.SetUint(u)
+	case reflect.String:
+		s, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(s))
+	case reflect.Slice:
+		return d.decodeSlice(v, depth)
+	case reflect.Ptr:
+		f, err := d.flag()
+		if err != nil || !f {
+			return err
+		}
+		p := reflect.New(v.Type().Elem())
+		err = d.decodeValue(p.Elem(), depth+1)
+		if err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Struct:
+		for c := 0; c < v.NumField(); c++ {
+			if v.Type().Field(c).PkgPath != "" {
+				continue //Not exported
+			}
+			err := d.decodeValue(v.Field(c), depth)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return griperrors.UnsupportedFieldType
+	}
+	return nil
+}
+
+func (d *decoder) decodeSlice(v reflect.Value, depth int) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		s, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if len(s) > 0 {
+			v.SetBytes(append([]byte(nil), s...))
+		}
+		return nil
+	}
+	//Every element takes at least one byte
+	l, err := d.length()
+	if err != nil || l == 0 {
+		return err
+	}
+	s := reflect.MakeSlice(v.Type(), l, l)
+	for c := 0; c < l; c++ {
+		err = d.decodeValue(s.Index(c), depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
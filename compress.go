@@ -0,0 +1,195 @@
+package grip
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//CAPDEFLATE the node reads Compressed messages
+const CAPDEFLATE string = "deflate"
+
+//COMPRESSBATCHSIZE records are sent together once this many
+//encoded bytes are waiting, or nothing else is queued
+const COMPRESSBATCHSIZE int = 64 * 1024
+
+//COMPRESSSAMPLESIZE how much of a file chunk is compressed to see
+//if the rest is worth it
+const COMPRESSSAMPLESIZE int = 4 * 1024
+
+//COMPRESSMINSAVING a sample must shrink by at least this many
+//percent.  Data that is already compressed will not.
+const COMPRESSMINSAVING int = 10
+
+//Compressed is one or more encoded messages, each after its
+//length, compressed with DEFLATE
+type Compressed struct {
+	Data []byte
+}
+
+//compressedFile is a Compressed FileChunk, so it is counted as
+//file data when it is sent
+type compressedFile Compressed
+
+//DeflateMessages encodes and compresses ml into one message
+func DeflateMessages(ml []interface{}) (Compressed, error) {
+	var c Compressed
+	var raw bytes.Buffer
+	for _, m := range ml {
+		b, err := EncodeMessage(m)
+		if err != nil {
+			return c, err
+		}
+		appendLength(&raw, b)
+	}
+	return deflateBytes(raw.Bytes())
+}
+
+func appendLength(w *bytes.Buffer, b []byte) {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)))
+	w.Write(l[:n])
+	w.Write(b)
+}
+
+func deflateBytes(b []byte) (Compressed, error) {
+	var c Compressed
+	var z bytes.Buffer
+	w, err := flate.NewWriter(&z, flate.DefaultCompression)
+	if err != nil {
+		return c, err
+	}
+	w.Write(b)
+	err = w.Close()
+	c.Data = z.Bytes()
+	return c, err
+}
+
+//InflateMessages the messages in c.  It will not inflate to more
+//than MAXFRAMESIZE, or hold another Compressed.
+func InflateMessages(c Compressed) ([]interface{}, error) {
+	zr := flate.NewReader(bytes.NewReader(c.Data))
+	defer zr.Close()
+	raw, err := ioutil.ReadAll(io.LimitReader(zr, int64(MAXFRAMESIZE)+1))
+	if err != nil {
+		return nil, griperrors.MalformedMessage
+	}
+	if len(raw) > MAXFRAMESIZE {
+		return nil, griperrors.FrameTooLarge
+	}
+	var ml []interface{}
+	r := bytes.NewReader(raw)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return ml, nil
+		}
+		if err != nil || n > uint64(r.Len()) {
+			return nil, griperrors.MalformedMessage
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		m, err := DecodeMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m.(Compressed); ok {
+			return nil, griperrors.MalformedMessage
+		}
+		ml = append(ml, m)
+	}
+}
+
+//Compressible true if a sample of b gets enough smaller
+func Compressible(b []byte) bool {
+	s := b
+	if len(s) > COMPRESSSAMPLESIZE {
+		s = s[:COMPRESSSAMPLESIZE]
+	}
+	if len(s) == 0 {
+		return false
+	}
+	var z bytes.Buffer
+	w, err := flate.NewWriter(&z, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	w.Write(s)
+	w.Close()
+	return z.Len()*100 <= len(s)*(100-COMPRESSMINSAVING)
+}
+
+//compressFileChunk the message to send for ch
+func (ctrl *ConnectionController) compressFileChunk(ch FileChunk) interface{} {
+	if !ctrl.HasFeature(CAPDEFLATE) || !Compressible(ch.Data) {
+		return ch
+	}
+	c, err := DeflateMessages([]interface{}{ch})
+	if err != nil {
+		return ch
+	}
+	return compressedFile(c)
+}
+
+//sendRecord records wait in a batch when the other node reads
+//Compressed messages.  A ContextFile is sent as it is, its data
+//follows in FileChunks that are compressed on their own.  The
+//batch is never more than MAXFRAMESIZE once inflated, a record
+//too large to fit on its own is sent as it is.
+func (ctrl *ConnectionController) sendRecord(d interface{}) error {
+	if _, cf := d.(*gripdata.ContextFile); cf || !ctrl.HasFeature(CAPDEFLATE) {
+		return ctrl.sendCounted(d)
+	}
+	b, err := EncodeMessage(d)
+	if err != nil {
+		return err
+	}
+	n := len(b) + binary.MaxVarintLen64
+	if ctrl.batch.Len()+n > MAXFRAMESIZE {
+		err = ctrl.flushRecords()
+		if err != nil {
+			return err
+		}
+	}
+	if n > MAXFRAMESIZE {
+		return ctrl.sendCounted(d)
+	}
+	appendLength(&ctrl.batch, b)
+	if ctrl.batch.Len() >= COMPRESSBATCHSIZE {
+		return ctrl.flushRecords()
+	}
+	return nil
+}
+
+//flushRecords send the records waiting in the batch
+func (ctrl *ConnectionController) flushRecords() error {
+	if ctrl.batch.Len() == 0 {
+		return nil
+	}
+	c, err := deflateBytes(ctrl.batch.Bytes())
+	ctrl.batch.Reset()
+	if err != nil {
+		return err
+	}
+	return ctrl.sendCounted(c)
+}
+
+//readCompressed reads the messages in c as if they came one by one
+func (ctrl *ConnectionController) readCompressed(c Compressed) error {
+	ml, err := InflateMessages(c)
+	if err != nil {
+		return err
+	}
+	for _, m := range ml {
+		err = ctrl.readSwitch(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,59 +1,94 @@
 package grip
 
 import (
+	"bytes"
 	"encoding/base64"
-	"errors"
 	"log"
 	"os"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/orcaman/concurrent-map"
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
 //ConnectionController is a handle for connections
 type ConnectionController struct {
 	sync.Mutex
 	C             Connection
-	SendChan      chan interface{}
-	Done          bool
+	Queue         *SendQueue
+	done          int32 //1 once closed, use IsDone
 	Incoming      bool
 	DB            DB
 	SocketCtrl    *SocketController
-	Pending       cmap.ConcurrentMap
+	Pending       cmap.ConcurrentMap //The SendData offered to the other node by digest
 	ConID         uint64
-	LastReadLoop  uint64
-	LastWriteLoop uint64
+	LastReadLoop  uint64          //When a message was last read, use atomic
+	LastWriteLoop uint64          //When the write routine last looped, use atomic
+	Introduced    chan bool       //Closed once the other node's Introduction is read
+	PeerVersion   uint32          //The protocol version both nodes agreed on
+	Features      map[string]bool //Capabilities both nodes support
+	introOnce     sync.Once
+	downloads     map[string]*fileDownload    //Only used holding recLock
+	Lanes         FileLanes                   //Only used by the write routine
+	lastFromDB    time.Time                   //Only used by the write routine
+	lastPing      time.Time                   //Only used by the write routine
+	lastSync      time.Time                   //Only used by the write routine
+	mail          mailState                   //Only used by the write routine
+	batch         bytes.Buffer                //Records waiting to be compressed, only used by the write routine
+	digs          digBatch                    //Only used holding recLock
+	recLock       sync.Mutex                  //Held while records are processed, by the read routine or for orphans
+	reading       int32                       //1 while the read routine waits on the other node
+	relayEnds     map[uint64]*RelayConnection //Relayed connections through this one, nil once closed
+	relayLock     sync.Mutex
+	sent          *RateLimit
+	fileSent      *RateLimit
+	limits        trafficLimits //Everything sent on the connection goes through these
+	fileLimits    trafficLimits //File data goes through these too
 }
 
-//Close a connection
+//IsDone the connection has been closed
+func (ctrl *ConnectionController) IsDone() bool {
+	return atomic.LoadInt32(&ctrl.done) == 1
+}
+
+//Close a connection.  Any routine may call it, any number
+//of times.  The write routine closes the Connection itself.
 func (ctrl *ConnectionController) Close() {
-	//Empty SendChan in case sendToChan is blocking on
-	//a full channel keeping us from getting the ctrl lock
-	go func() {
-		for nil != <-ctrl.SendChan {
-		}
-	}()
 	ctrl.Lock()
-	if !ctrl.Done {
-		ctrl.Done = true
-		close(ctrl.SendChan)
+	if !ctrl.IsDone() {
+		atomic.StoreInt32(&ctrl.done, 1)
 		if ctrl.SocketCtrl != nil {
-			ctrl.SocketCtrl.removeConnection(ctrl.C.GetNodeID())
+			ctrl.SocketCtrl.removeConnection(ctrl)
 		}
 	}
 	ctrl.Unlock()
+	ctrl.Queue.Close()
 }
 
-//This is nasty, should just find way of only closing SendChan once done sending
-//for good
-func (ctrl *ConnectionController) sendToChan(d interface{}) {
-	ctrl.Lock()
-	defer ctrl.Unlock()
-	if !ctrl.Done {
-		ctrl.SendChan <- d
+//drain closes the connection once everything queued has been
+//sent.  A connection still waiting on the other node's
+//Introduction has nothing worth sending, so it is just closed.
+func (ctrl *ConnectionController) drain() {
+	select {
+	case <-ctrl.Introduced:
+		ctrl.Queue.Drain()
+	default:
+		ctrl.Close()
+	}
+}
+
+//queueSend hands d to the write routine.  If the queue is full the
+//other node is asking for more than it reads, so we stop reading
+//until there is room.  If there is none after SENDQUEUEWAIT we
+//give up on it.  Never call it from the write routine.
+func (ctrl *ConnectionController) queueSend(d interface{}) {
+	err := ctrl.Queue.PushWait(d, SENDQUEUEWAIT)
+	if err == griperrors.SendQueueFull {
+		log.Printf("Send queue full, closing connection: %d", ctrl.ConID)
+		ctrl.Close()
 	}
 }
 
@@ -62,7 +97,7 @@ func (ctrl *ConnectionController) convertFT2SD(c *gripdata.ContextFileTransferWr
 	var cf *gripdata.ContextFile
 	s.Dig = c.ContextFileTransfer.ContextFileDig
 	s.TargetID = ctrl.C.GetNodeID()
-	s.TypeName = reflect.TypeOf(cf).String()
+	s.TypeName = WireTypeName(cf)
 	return s
 }
 
@@ -80,8 +115,16 @@ func (ctrl *ConnectionController) startFileTransfer() (int, error) {
 }
 
 func (ctrl *ConnectionController) sendFromDatabase() (int, error) {
-	sl := ctrl.DB.GetSendData(ctrl.C.GetNodeID(), MAXSEND)
-	err := ctrl.sendSendDataList(sl)
+	ctrl.lastFromDB = time.Now()
+	if ctrl.throttled() {
+		return 0, nil
+	}
+	err := ctrl.syncContexts()
+	if err != nil {
+		return 0, err
+	}
+	sl := ctrl.DB.GetSendData(ctrl.C.GetNodeID(), ctrl.sendLimit())
+	err = ctrl.sendSendDataList(sl)
 	if err != nil {
 		return 0, err
 	}
@@ -89,32 +132,40 @@ func (ctrl *ConnectionController) sendFromDatabase() (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(sl) + c, nil
+	m, err := ctrl.sendMail()
+	if err != nil {
+		return 0, err
+	}
+	return len(sl) + c + m, nil
 }
 
 func (ctrl *ConnectionController) sendFromList(v *gripdata.SendData) error {
 	ds := base64.StdEncoding.EncodeToString(v.Dig)
-	fnd := false
-	val, ok := ctrl.Pending.Get(ds)
-	if ok {
-		fnd = val.(bool)
-	}
-	if !fnd {
+	if _, fnd := ctrl.Pending.Get(ds); !fnd {
 		var cd CheckDig
 		cd.Dig = v.Dig
 		err := ctrl.C.Send(cd)
 		if err != nil {
 			return err
 		}
-		ctrl.Pending.Set(ds, true)
+		ctrl.Pending.Set(ds, *v)
 	}
 	return nil
 }
 
+//sendSendDataList stops when MAXPENDING digests are waiting on
+//the other node.  The rest are sent as it catches up.
 func (ctrl *ConnectionController) sendSendDataList(sl []gripdata.SendData) error {
+	sl = ctrl.skipSeen(sl)
+	if ctrl.HasFeature(CAPBATCHDIGS) {
+		return ctrl.sendCheckDigs(sl)
+	}
 	for _, v := range sl {
-		if ctrl.Done {
-			return errors.New("Connection closed")
+		if ctrl.IsDone() {
+			return griperrors.ConnectionClosed
+		}
+		if ctrl.Pending.Count() >= MAXPENDING {
+			return nil
 		}
 		err := ctrl.sendFromList(&v)
 		if err != nil {
@@ -127,7 +178,7 @@ func (ctrl *ConnectionController) sendSendDataList(sl []gripdata.SendData) error
 func (ctrl *ConnectionController) sendSendData(d []byte) error {
 	sd := ctrl.DB.GetDigestData(d)
 	if sd != nil {
-		err := ctrl.C.Send(sd)
+		err := ctrl.sendRecord(sd)
 		if err != nil {
 			return err
 		}
@@ -158,19 +209,20 @@ func (ctrl *ConnectionController) deleteSendDataOrFileTransfer(d []byte) error {
 	return nil
 }
 
-func (ctrl *ConnectionController) sendDataRejected(d []byte, msg string) error {
+func (ctrl *ConnectionController) sendDataRejected(d []byte, rerr error) {
 	var r RejectDig
 	r.Dig = d
-	r.Message = msg
-	return ctrl.C.Send(r)
+	r.Message = rerr.Error()
+	r.Code = griperrors.Code(rerr)
+	ctrl.queueSend(r)
 }
 
-func (ctrl *ConnectionController) dataRejected(d []byte) error {
-	err := ctrl.storeDataRejected(d)
+func (ctrl *ConnectionController) dataRejected(v RejectDig) error {
+	err := ctrl.storeDataRejected(v)
 	if err != nil {
 		return err
 	}
-	err = ctrl.deleteSendDataOrFileTransfer(d)
+	err = ctrl.deleteSendDataOrFileTransfer(v.Dig)
 	if err != nil {
 		return err
 	}
@@ -197,7 +249,7 @@ func (ctrl *ConnectionController) getFileTransferData() error {
 					//ask this connected node for a copy of the file
 					var crq ReqContextFile
 					crq.Dig = xfr.ContextFileTransfer.ContextFileDig
-					ctrl.sendToChan(crq)
+					ctrl.queueSend(crq)
 				}
 			}
 		}
@@ -205,11 +257,21 @@ func (ctrl *ConnectionController) getFileTransferData() error {
 	return nil
 }
 
-func (ctrl *ConnectionController) storeDataRejected(d []byte) error {
+func (ctrl *ConnectionController) storeDataRejected(v RejectDig) error {
 	r := gripdata.RejectedSendData{}
-	r.Dig = d
+	r.Dig = v.Dig
 	r.TargetID = ctrl.C.GetNodeID()
 	r.Timestamp = uint64(time.Now().UnixNano())
+	r.Message = renderReason(v.Code, v.Message, ctrl.DB)
+	r.Code = v.Code
+	if p, ok := ctrl.Pending.Get(base64.StdEncoding.EncodeToString(v.Dig)); ok {
+		s := p.(gripdata.SendData)
+		r.TypeName = s.TypeName
+		r.Retries = s.Retries
+	} else if d := ctrl.DB.GetDigestData(v.Dig); d != nil {
+		//It was offered on an older connection
+		r.TypeName = WireTypeName(d)
+	}
 	err := ctrl.DB.StoreRejectedSendData(&r)
 	if err != nil {
 		return err
@@ -220,10 +282,13 @@ func (ctrl *ConnectionController) storeDataRejected(d []byte) error {
 func (ctrl *ConnectionController) processSendError(fname string, dig []byte, err error) {
 	if err == nil {
 		log.Printf("%s data received", fname)
-		ctrl.sendToChan(AckDig{Dig: dig})
+		ctrl.seen(dig)
+		ctrl.ackRecord(dig)
+		ctrl.orphansLanded(dig)
 	} else {
 		log.Printf("%s data rejected: %s", fname, err)
-		ctrl.sendDataRejected(dig, err.Error())
+		ctrl.unwant(dig)
+		ctrl.sendDataRejected(dig, err)
 	}
 }
 
@@ -235,8 +300,13 @@ func (ctrl *ConnectionController) setConnected(incomming bool) {
 	}
 }
 
+//setConnectionClosed leaves the Node Ephemera alone if another
+//connection to the node replaced this one
 func (ctrl *ConnectionController) setConnectionClosed() {
 	log.Printf("Connection closed: %d", ctrl.ConID)
+	if ctrl.SocketCtrl != nil && ctrl.SocketCtrl.checkConnection(ctrl.C.GetNodeID()) {
+		return
+	}
 	err := ctrl.DB.SetNodeEphemeraClosed(ctrl.C.GetNodeID())
 	if err != nil {
 		log.Printf("Error setting connection closed: %s", err)
@@ -2,32 +2,13 @@ package grip
 
 import (
 	"log"
-	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
-func (ctrl *ConnectionController) sendIntroduction() {
-	myn, _ := ctrl.DB.GetPrivateNodeData()
-	err := ctrl.C.Send(myn)
-	if err != nil {
-		log.Print("Failed to send my node data for connection init")
-		ctrl.Close()
-	}
-}
-
-func (ctrl *ConnectionController) sendTimeout(sent int) <-chan bool {
-	timeout := make(chan bool, 1)
-	go func(ct int) {
-		if ct == 0 {
-			time.Sleep(SLEEPONNOSEND)
-		}
-		timeout <- true
-	}(sent)
-	return timeout
-}
-
 func (ctrl *ConnectionController) sendData(r interface{}) (int, error) {
 	var err error
 	sent := 0
@@ -38,124 +19,270 @@ func (ctrl *ConnectionController) sendData(r interface{}) (int, error) {
 		} else {
 			err = ctrl.sendSendData(v.Dig)
 		}
-	case bool:
-		sent, err = ctrl.sendFromDatabase()
+	case serveFileChunks:
+		ctrl.grantFileChunks(FileChunkReq(v))
+	case mailAnswer:
+		err = ctrl.mailAnswered(MailResp(v))
+	case sendDigs:
+		err = ctrl.sendWanted(RespDigs(v))
 	default:
-		err = ctrl.C.Send(v)
+		err = ctrl.sendCounted(v)
 	}
 	return sent, err
 }
 
-func (ctrl *ConnectionController) sendSelect(sent int) (int, error) {
-	var err error
-	timeout := ctrl.sendTimeout(sent)
+//sendFileOrDatabase file data is only sent when no control
+//message is waiting, but the database is still checked for
+//new data while a file is moving
+func (ctrl *ConnectionController) sendFileOrDatabase() (int, error) {
+	if time.Since(ctrl.lastFromDB) >= SLEEPONNOSEND {
+		return ctrl.sendFromDatabase()
+	}
+	return 0, ctrl.sendFileChunk()
+}
+
+//waitToSend wait for something to be queued, or until it is time
+//to check the database again.  If the last check found data there
+//is no wait.
+func (ctrl *ConnectionController) waitToSend(sent int) (int, error) {
+	if sent > 0 {
+		return ctrl.sendFromDatabase()
+	}
+	t := time.NewTimer(SLEEPONNOSEND)
+	defer t.Stop()
 	select {
-	case r, ok := <-ctrl.SendChan:
-		if !ok || ctrl.Done {
-			//Do not call ctrl.Close() because
-			//its only purpose is to close ctlr.S
-			//so that this routine exits.
-			ctrl.Done = true
-		} else {
-			sent, err = ctrl.sendData(r)
+	case <-ctrl.Queue.Ready():
+	case <-ctrl.Queue.Done():
+		//Do not call ctrl.Close() because
+		//its only purpose is to close ctlr.S
+		//so that this routine exits.
+		atomic.StoreInt32(&ctrl.done, 1)
+	case <-t.C:
+		err := ctrl.keepAlive()
+		if err != nil {
+			return 0, err
 		}
-	case <-timeout:
-		sent, err = ctrl.sendFromDatabase()
+		return ctrl.sendFromDatabase()
 	}
-	return sent, err
+	return sent, nil
+}
+
+//sendSelect control messages in the queue always go first
+func (ctrl *ConnectionController) sendSelect(sent int) (int, error) {
+	r, ok := ctrl.Queue.Pop()
+	if ok {
+		return ctrl.sendData(r)
+	}
+	err := ctrl.flushRecords()
+	if err != nil {
+		return 0, err
+	}
+	if ctrl.Queue.Draining() {
+		ctrl.Close()
+		return 0, nil
+	}
+	if ctrl.Lanes.Active() {
+		return ctrl.sendFileOrDatabase()
+	}
+	return ctrl.waitToSend(sent)
 }
 
 func (ctrl *ConnectionController) sendLoop(sent int) {
-	for !ctrl.Done {
+	for !ctrl.IsDone() {
 		var err error
 		sent, err = ctrl.sendSelect(sent)
 		if err != nil {
 			ctrl.Close()
 		}
-		ctrl.LastWriteLoop = uint64(time.Now().UnixNano())
+		ctrl.writeLoopDone()
 	}
 }
 
 //ConnectionWriteRoutine go routine to write to connections
 func (ctrl *ConnectionController) ConnectionWriteRoutine() {
 	defer func() {
+		ctrl.Lanes.Close()
 		ctrl.setConnectionClosed()
 		ctrl.C.Close() //Only close connection here
 	}()
-	if !ctrl.Done {
+	if !ctrl.IsDone() {
 		ctrl.setConnected(ctrl.Incoming)
 		ctrl.sendIntroduction()
-		sent, err := ctrl.sendFromDatabase()
-		if err != nil {
-			ctrl.Close()
+		//Nothing else is sent until we know what
+		//the other node supports
+		if ctrl.waitForIntroduction() {
+			sent, err := ctrl.sendFromDatabase()
+			if err != nil {
+				ctrl.Close()
+			}
+			ctrl.sendLoop(sent)
 		}
-		ctrl.sendLoop(sent)
 	}
 }
 
+//readSwitch an error means the connection cannot be trusted and
+//is closed.  A record that fails is only rejected.
 func (ctrl *ConnectionController) readSwitch(d interface{}) (err error) {
+	if !carriesRecords(d) {
+		ctrl.flushAcks()
+	}
 	switch v := d.(type) {
 	default:
-		log.Printf("Unknown type: %s\n", reflect.TypeOf(v).String())
+		err = griperrors.UnknownMessageType
 	case CheckDig:
+		ctrl.seen(v.Dig)
 		t := ctrl.DB.GetDigestData(v.Dig)
 		var rsp RespDig
 		rsp.Dig = v.Dig
 		rsp.HaveIt = (t != nil)
-		ctrl.sendToChan(rsp)
+		ctrl.queueSend(rsp)
 	case RespDig:
+		if v.HaveIt {
+			ctrl.seen(v.Dig)
+		}
 		var sd SendDig
 		sd.Dig = v.Dig
 		sd.HaveIt = v.HaveIt
-		ctrl.sendToChan(sd)
+		ctrl.queueSend(sd)
 	case RejectDig:
-		err = ctrl.dataRejected(v.Dig)
-		if err != nil {
-			log.Printf("Failed to process rejection! %s", err)
+		derr := ctrl.dataRejected(v)
+		if derr != nil {
+			log.Printf("Failed to process rejection! %s", derr)
 		}
 	case AckDig:
-		err = ctrl.deleteSendDataOrFileTransfer(v.Dig)
-		if err != nil {
-			log.Printf("Failed to delete SendData! %s", err)
+		ctrl.seen(v.Dig)
+		derr := ctrl.deleteSendDataOrFileTransfer(v.Dig)
+		if derr != nil {
+			log.Printf("Failed to delete SendData! %s", derr)
 		}
+	case CheckDigs:
+		ctrl.checkDigs(v)
+	case RespDigs:
+		for i, d := range v.Digs {
+			if v.HasDig(i) {
+				ctrl.seen(d)
+			}
+		}
+		//Records are read by the write routine
+		ctrl.queueSend(sendDigs(v))
+	case AckDigs:
+		ctrl.ackDigs(v)
+	case SyncRoot:
+		ctrl.syncRoot(v)
+	case SyncBuckets:
+		ctrl.syncBuckets(v)
+	case SyncDigs:
+		ctrl.syncDigs(v)
+	case SyncWant:
+		ctrl.syncWant(v)
+	case FileChunkReq:
+		//Files are read by the write routine
+		ctrl.queueSend(serveFileChunks(v))
+	case FileChunk:
+		ctrl.fileChunk(v)
+	case Compressed:
+		err = ctrl.readCompressed(v)
+	case Ping:
+		ctrl.queueSend(Pong{Nonce: v.Nonce})
+	case Pong:
+		//Hearing it is all that matters
+	case RelayReq:
+		ctrl.relayReq(v)
+	case RelayOpen:
+		ctrl.relayOpen(v)
+	case RelayData:
+		ctrl.relayData(v)
+	case RelayClose:
+		ctrl.relayClose(v)
+	case MailOffer:
+		ctrl.mailOffer(v)
+	case MailResp:
+		//Records are read by the write routine
+		ctrl.queueSend(mailAnswer(v))
+	case MailDeposit:
+		ctrl.mailDeposit(v)
+	case MailItem:
+		ctrl.mailItem(v)
+	case MailAck:
+		ctrl.mailAck(v)
+	case MailReceipt:
+		ctrl.mailReceipt(v)
+	case *gripdata.ContextFile:
+		//Its data can take a while, the records that came with
+		//it are acknowledged without waiting
+		ctrl.unwant(v.Dig)
+		ctrl.incomingContextFile(v)
+	case *gripdata.Node, *gripdata.AssociateNodeAccountKey, *gripdata.UseShareNodeKey,
+		*gripdata.ShareNodeInfo, *gripdata.Context, *gripdata.ContextRequest,
+		*gripdata.ContextResponse, *gripdata.ContextFileTransfer:
+		ctrl.processRecord(v)
+	}
+	return err
+}
+
+//processRecord stores the record, or holds it if a record it
+//needs has not come yet
+func (ctrl *ConnectionController) processRecord(d interface{}) {
+	n, dig, err := incomingRecord(d, ctrl.DB)
+	if err != nil && ctrl.holdOrphan(n, d, dig, err) {
+		return
+	}
+	ctrl.processSendError(n, dig, err)
+}
+
+//incomingRecord stores a signed record from another node.  The
+//name is for the log.
+func incomingRecord(d interface{}, db DB) (string, []byte, error) {
+	switch v := d.(type) {
 	case *gripdata.Node:
-		err = IncomingNode(v, ctrl.DB)
-		ctrl.processSendError("Node", v.Dig, err)
+		return "Node", v.Dig, IncomingNode(v, db)
 	case *gripdata.AssociateNodeAccountKey:
-		err = IncomingNodeAccountKey(v, ctrl.DB)
-		ctrl.processSendError("AssociateNodeAccountKey", v.Dig, err)
+		return "AssociateNodeAccountKey", v.Dig, IncomingNodeAccountKey(v, db)
 	case *gripdata.UseShareNodeKey:
-		err = IncomingUseShareNodeKey(v, ctrl.DB)
-		ctrl.processSendError("UseShareNodeKey", v.Dig, err)
+		return "UseShareNodeKey", v.Dig, IncomingUseShareNodeKey(v, db)
 	case *gripdata.ShareNodeInfo:
-		err = IncomingShareNode(v, ctrl.DB)
-		ctrl.processSendError("ShareNodeInfo", v.Dig, err)
+		return "ShareNodeInfo", v.Dig, IncomingShareNode(v, db)
 	case *gripdata.Context:
-		err = IncomingContext(v, ctrl.DB)
-		ctrl.processSendError("Context", v.Dig, err)
+		return "Context", v.Dig, IncomingContext(v, db)
 	case *gripdata.ContextRequest:
-		err = IncomingContextRequest(v, ctrl.DB)
-		ctrl.processSendError("ContextRequest", v.Dig, err)
+		return "ContextRequest", v.Dig, IncomingContextRequest(v, db)
 	case *gripdata.ContextResponse:
-		err = IncomingContextResponse(v, ctrl.DB)
-		ctrl.processSendError("ContextResponse", v.Dig, err)
-	case *gripdata.ContextFile:
-		err = IncomingContextFile(v, ctrl.DB)
-		ctrl.processSendError("ContextFile", v.Dig, err)
+		return "ContextResponse", v.Dig, IncomingContextResponse(v, db)
 	case *gripdata.ContextFileTransfer:
-		err = IncomingFileTransfer(v, ctrl.DB)
-		ctrl.processSendError("ContextFileTransfer", v.Dig, err)
+		return "ContextFileTransfer", v.Dig, IncomingFileTransfer(v, db)
 	}
-	return err
+	return "", nil, griperrors.UnknownMessageType
 }
 
-func (ctrl *ConnectionController) readLoop() error {
+//read marks the read routine as waiting on the other node
+//so the supervisor does not think it is stuck
+func (ctrl *ConnectionController) read() (interface{}, error) {
+	atomic.StoreInt32(&ctrl.reading, 1)
 	d, err := ctrl.C.Read()
-	for err == nil && !ctrl.Done {
+	atomic.StoreInt32(&ctrl.reading, 0)
+	ctrl.readLoopDone()
+	return d, err
+}
+
+func (ctrl *ConnectionController) readLoop() error {
+	d, err := ctrl.read()
+	if err == nil {
+		err = ctrl.readIntroduction(d)
+		if err == nil {
+			d, err = ctrl.read()
+		}
+	}
+	for err == nil && !ctrl.IsDone() {
 		if d != nil {
+			ctrl.recLock.Lock()
 			err = ctrl.readSwitch(d)
-			d, err = ctrl.C.Read()
-			ctrl.LastReadLoop = uint64(time.Now().UnixNano())
+			ctrl.recLock.Unlock()
+			if err != nil {
+				log.Printf("Failed to read %s", WireTypeName(d))
+				return err
+			}
+			ctrl.retryOrphans()
+			d, err = ctrl.read()
 		}
 	}
 	return err
@@ -163,6 +290,10 @@ func (ctrl *ConnectionController) readLoop() error {
 
 //ConnectionReadRoutine go routine to read from connections
 func (ctrl *ConnectionController) ConnectionReadRoutine() {
+	defer ctrl.endIntroduction()
+	defer ctrl.closeDownloads()
+	defer ctrl.closeRelays()
+	defer ctrl.dropOrphans()
 	defer ctrl.Close()
 	err := ctrl.readLoop()
 	if err != nil {
@@ -2,12 +2,13 @@ package grip
 
 import (
 	"bytes"
-	"errors"
+	"encoding/base64"
 	"log"
 	"os"
 
 	"github.com/wyathan/grip/gripcrypto"
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
 func doesContextFielHaveLoop(head []byte, dep *gripdata.ContextFileWrap, db DB) bool {
@@ -81,6 +82,28 @@ func IsContextFileDepsOk(c *gripdata.ContextFile, db DB) (r bool) {
 	return true
 }
 
+//MissingContextFileParent the first DependsOn we have no
+//ContextFile for, nil if we have them all.  A file we deleted
+//counts as one we have.
+func MissingContextFileParent(c *gripdata.ContextFile, db DB) []byte {
+	var deleted map[string]bool
+	for _, dd := range c.DependsOn {
+		if db.GetContextFileByDepDataDig(dd) != nil {
+			continue
+		}
+		if deleted == nil {
+			deleted = make(map[string]bool)
+			for _, d := range db.GetContextFilesDeleted(c.Context) {
+				deleted[base64.StdEncoding.EncodeToString(d.DataDepDig)] = true
+			}
+		}
+		if !deleted[base64.StdEncoding.EncodeToString(dd)] {
+			return dd
+		}
+	}
+	return nil
+}
+
 func filterContextRequest(c *gripdata.ContextRequest, db DB) *gripdata.ContextRequest {
 	if c == nil {
 		return nil
@@ -118,7 +141,7 @@ func sendToContextParticipant(c gripcrypto.SignInf, ct *gripdata.ContextRequest,
 	if fr != nil {
 		err := CreateNewSend(c, ct.TargetNodeID, db)
 		if err != nil {
-			return errors.New("Failed to create send request")
+			return griperrors.CreateSendFailed
 		}
 	}
 	return nil
@@ -146,11 +169,11 @@ func SendToAllContextParticipants(c gripcrypto.SignInf, ctxid []byte, db DB) err
 	//Send to the context owner
 	ctx := db.GetContext(ctxid)
 	if ctx == nil {
-		return errors.New("Context is not found")
+		return griperrors.ContextNotFound
 	}
 	err := CreateNewSend(c, ctx.NodeID, db)
 	if err != nil {
-		return errors.New("Failed to create send request")
+		return griperrors.CreateSendFailed
 	}
 	//Send to all with responses
 	err = findAndSendToContextParticipants(c, ctxid, db)
@@ -163,10 +186,10 @@ func SendToAllContextParticipants(c gripcrypto.SignInf, ctxid []byte, db DB) err
 func validateFileSetSize(c *gripdata.ContextFile) error {
 	st, err := os.Stat(c.GetPath())
 	if os.IsNotExist(err) {
-		return errors.New("Path does not exist")
+		return griperrors.PathNotFound
 	}
 	if (st.Mode() & os.ModeType) != 0 {
-		return errors.New("Path is not a regular file")
+		return griperrors.PathNotRegularFile
 	}
 	c.Size = uint64(st.Size())
 	return nil
@@ -176,10 +199,10 @@ func isAllowedToCreateFile(c *gripdata.ContextFile, db DB) error {
 	myn, _ := db.GetPrivateNodeData()
 	ctx := db.GetContext(c.Context)
 	if ctx == nil {
-		return errors.New("Context is unknown")
+		return griperrors.ContextNotFound
 	}
 	if !IsIfValidContextSource(myn.ID, ctx, db) {
-		return errors.New("You do not have context source permission")
+		return griperrors.NotContextSource
 	}
 	return nil
 }
@@ -192,11 +215,11 @@ func validateContextFileDepsAndSign(c *gripdata.ContextFile, db DB) error {
 	}
 	dd := db.GetContextFileByDepDataDig(c.DataDepDig)
 	if dd != nil {
-		return errors.New("We already have this file")
+		return griperrors.ContextFileExists
 	}
 	//Check for dependency problems
 	if !IsContextFileDepsOk(c, db) {
-		return errors.New("There were dependency problems")
+		return griperrors.DependencyProblems
 	}
 	return nil
 }
@@ -2,7 +2,6 @@ package grip
 
 import (
 	"bytes"
-	"errors"
 	"log"
 	"os"
 
@@ -43,26 +42,26 @@ func IncomingContextRequest(c *gripdata.ContextRequest, db DB) error {
 	//See if there's a duplicate request already from another node
 	rqst := db.GetContextRequest(c.ContextDig, c.TargetNodeID)
 	if rqst != nil {
-		return errors.New("There is already a ContextRequest for this node")
+		return griperrors.ContextRequestExists
 	}
 	//Check if requester can request!
 	ctx := db.GetContext(c.ContextDig)
 	if ctx == nil {
-		return errors.New("Context was not found")
+		return griperrors.ContextNotFound
 	}
 	if !bytes.Equal(ctx.NodeID, c.NodeID) {
 		//Check if the node was granted permission
 		req := db.GetContextRequest(c.ContextDig, c.NodeID)
 		rsp := db.GetContextResponse(c.ContextDig, c.NodeID)
 		if req == nil || rsp == nil {
-			return errors.New("Missing request/response from source node")
+			return griperrors.ContextPairNotFound
 		}
 		if !(req.AllowContextNode && rsp.ContextNode) {
-			return errors.New("Source node does not have permission add nodes")
+			return griperrors.NotContextNode
 		}
 		//Make sure that request creator is not escilating permissions for new node
 		if !CheckNonEscalating(req, c) {
-			return errors.New("Cannot escalate permissions")
+			return griperrors.PermissionEscalation
 		}
 	}
 	err = db.StoreContextRequest(c)
@@ -72,12 +71,12 @@ func IncomingContextRequest(c *gripdata.ContextRequest, db DB) error {
 	if bytes.Equal(pr.ID, c.TargetNodeID) {
 		//This is for me
 		if !IsAccountEnabled(c, db) {
-			return errors.New("Sorry, this account is not enabled")
+			return griperrors.AccountNotEnabled
 		}
 		if pr.AutoContextResponse {
 			a := GetNodeAccount(c.NodeID, db)
 			if a.NumberContexts >= a.MaxContexts {
-				return errors.New("Too many contexts for account")
+				return griperrors.MaxContextsForAccount
 			}
 
 			//Create context response
@@ -152,7 +151,7 @@ func IncomingContextResponse(c *gripdata.ContextResponse, db DB) error {
 	//Forward to context creator
 	ctx := db.GetContext(c.ContextDig)
 	if ctx == nil {
-		return errors.New("Context not found")
+		return griperrors.ContextNotFound
 	}
 	err = CreateNewSend(c, ctx.NodeID, db)
 	if err != nil {
@@ -166,32 +165,73 @@ func IncomingContextResponse(c *gripdata.ContextResponse, db DB) error {
 	return nil
 }
 
-//IncomingContextFile process an incoming context file.  Check permission and forward
-//to participating nodes
-func IncomingContextFile(c *gripdata.ContextFile, db DB) error {
-	_, pr := db.GetPrivateNodeData()
-	if bytes.Equal(pr.ID, c.NodeID) {
-		//I created this.  Ignore it
-		return nil
-	}
+func checkIncomingContextFile(c *gripdata.ContextFile, db DB) (*gripdata.Context, *gripdata.Account, error) {
 	//Check the signature of the context file
 	_, err := VerifyNodeSig(c, db)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	ctx := db.GetContext(c.Context)
+	if ctx == nil {
+		return nil, nil, griperrors.ContextNotFound
+	}
 	if !IsIfValidContextSource(c.NodeID, ctx, db) {
 		db.StoreVeryBadContextFile(c)
 		log.Printf("Incoming ContextFile without permission: %s", c.Dig)
-		return griperrors.NotContextSource
+		return nil, nil, griperrors.NotContextSource
+	}
+	if !bytes.Equal(ctx.NodeID, c.NodeID) && db.GetContextResponse(c.Context, c.NodeID) == nil {
+		//The source is allowed, its ContextResponse may still be
+		//on the way
+		return nil, nil, griperrors.ContextPairNotFound
 	}
 	if !IsContextFileDepsOk(c, db) {
-		return griperrors.DependencyProblems
+		return nil, nil, griperrors.DependencyProblems
+	}
+	if MissingContextFileParent(c, db) != nil {
+		return nil, nil, griperrors.ContextFileParentNotFound
 	}
 	//Get the account for the creating node.
 	a := GetNodeAccount(c.NodeID, db)
 	if !((bytes.Equal(ctx.NodeID, c.NodeID) || a.AllowContextSource) && a.Enabled) {
-		return griperrors.NotContextSource
+		return nil, nil, griperrors.NotContextSource
+	}
+	return ctx, a, nil
+}
+
+//NeedContextFileData checks an incoming ContextFile and sets its path
+//to where its data is kept on this node.  Returns true if the data
+//still has to be fetched from another node.
+func NeedContextFileData(c *gripdata.ContextFile, db DB) (bool, error) {
+	_, pr := db.GetPrivateNodeData()
+	if bytes.Equal(pr.ID, c.NodeID) {
+		//I created this.  IncomingContextFile ignores it
+		return false, nil
+	}
+	if db.GetContextFileDeleted(c.Dig) != nil {
+		return false, nil
+	}
+	_, _, err := checkIncomingContextFile(c, db)
+	if err != nil {
+		return false, err
+	}
+	c.SetPath(ContextFileDataPath(pr, c))
+	_, err = os.Stat(c.GetPath())
+	return os.IsNotExist(err), nil
+}
+
+//IncomingContextFile process an incoming context file.  Check permission and forward
+//to participating nodes.  The file data must already be at the path
+//set by NeedContextFileData.
+func IncomingContextFile(c *gripdata.ContextFile, db DB) error {
+	_, pr := db.GetPrivateNodeData()
+	if bytes.Equal(pr.ID, c.NodeID) {
+		//I created this.  Ignore it
+		return nil
+	}
+	ctx, a, err := checkIncomingContextFile(c, db)
+	if err != nil {
+		return err
 	}
 	//Check if this is deleted for us
 	dl := db.GetContextFileDeleted(c.Dig)
@@ -2,11 +2,11 @@ package grip
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
+	"log"
 
 	"github.com/wyathan/grip/gripcrypto"
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
 //CheckNonEscalating Make sure the requesting node is not requesting more
@@ -29,10 +29,10 @@ func canNonOwnerCreateContextRequest(myid []byte, c *gripdata.ContextRequest, ct
 	myreq := db.GetContextRequest(ctx.Dig, myid)
 	myrsp := db.GetContextResponse(ctx.Dig, myid)
 	if !(myreq.AllowContextNode && myrsp.ContextNode) {
-		return errors.New("Not allowed to request new nodes for context")
+		return griperrors.NotContextNode
 	}
 	if !CheckNonEscalating(myreq, c) {
-		return errors.New("You cannot escilate permissions for a new node")
+		return griperrors.PermissionEscalation
 	}
 	return nil
 }
@@ -42,7 +42,7 @@ func canCreateContextRequest(c *gripdata.ContextRequest, db DB) (*gripdata.Conte
 	//Owner can do what he likes
 	ctx := db.GetContext(c.ContextDig)
 	if ctx == nil {
-		return nil, errors.New("Context is not found")
+		return nil, griperrors.ContextNotFound
 	}
 	if bytes.Equal(ctx.NodeID, myn.ID) {
 		//I'm the owner, it's ok
@@ -58,7 +58,7 @@ func canCreateContextRequest(c *gripdata.ContextRequest, db DB) (*gripdata.Conte
 func validateNewContextRequest(c *gripdata.ContextRequest, db DB) (*gripdata.Context, error) {
 	tid := db.GetNode(c.TargetNodeID)
 	if tid == nil {
-		return nil, errors.New("Unknown target node")
+		return nil, griperrors.TargetNodeNotFound
 	}
 	ctx, err := canCreateContextRequest(c, db)
 	if err != nil {
@@ -66,7 +66,7 @@ func validateNewContextRequest(c *gripdata.ContextRequest, db DB) (*gripdata.Con
 	}
 	rqst := db.GetContextRequest(c.ContextDig, c.TargetNodeID)
 	if rqst != nil {
-		return nil, errors.New("There is already a ContextRequest for this node")
+		return nil, griperrors.ContextRequestExists
 	}
 	return ctx, nil
 }
@@ -98,11 +98,11 @@ func validateAndSaveContextRequest(c *gripdata.ContextRequest, db DB) (*gripdata
 func sendToNewContextTarget(c *gripdata.ContextRequest, ctx *gripdata.Context, db DB) error {
 	err := CreateNewSend(ctx, c.TargetNodeID, db)
 	if err != nil {
-		return errors.New("Failed to create send request")
+		return griperrors.CreateSendFailed
 	}
 	err = CreateNewSend(c, c.TargetNodeID, db)
 	if err != nil {
-		return errors.New("Failed to create send request")
+		return griperrors.CreateSendFailed
 	}
 	return err
 }
@@ -141,14 +141,16 @@ func sendNewContextRequestToOthers(c *gripdata.ContextRequest, ctx *gripdata.Con
 	//Send to the creator
 	err := CreateNewSend(c, ctx.NodeID, db)
 	if err != nil {
-		return fmt.Errorf("Failed to create send request: %s", err)
+		log.Printf("Failed to send ContextRequest to the creator: %s", err)
+		return griperrors.CreateSendFailed
 	}
 	//Reciprocate data with other nodes participating in the context
 	clr := db.GetContextRequests(c.ContextDig)
 	for _, ct := range clr {
 		err = reciprocateNewContextData(c, ct, db)
 		if err != nil {
-			return fmt.Errorf("Failed to reciprocate context data: %s", err)
+			log.Printf("Failed to reciprocate context data: %s", err)
+			return griperrors.ReciprocateFailed
 		}
 	}
 	return nil
@@ -180,7 +182,7 @@ func SendToAllContextRequests(c gripcrypto.SignInf, cid []byte, db DB) error {
 	for _, ct := range clr {
 		err := CreateNewSend(c, ct.TargetNodeID, db)
 		if err != nil {
-			return errors.New("Failed to create send request")
+			return griperrors.CreateSendFailed
 		}
 	}
 	return nil
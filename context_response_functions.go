@@ -1,9 +1,9 @@
 package grip
 
 import (
-	"errors"
 
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
 func signAndStoreContextResponse(c *gripdata.ContextResponse, db DB) error {
@@ -23,11 +23,11 @@ func validateAndSaveContextResponse(c *gripdata.ContextResponse, db DB) (*gripda
 	myn, _ := db.GetPrivateNodeData()
 	req := db.GetContextRequest(c.ContextDig, myn.ID)
 	if req == nil {
-		return nil, errors.New("You have to have a request first")
+		return nil, griperrors.ContextRequestNotFound
 	}
 	ctx := db.GetContext(c.ContextDig)
 	if ctx == nil {
-		return nil, errors.New("Context is not found")
+		return nil, griperrors.ContextNotFound
 	}
 	err := signAndStoreContextResponse(c, db)
 	if err != nil {
@@ -44,7 +44,7 @@ func NewContextResponse(c *gripdata.ContextResponse, db DB) error {
 	}
 	err = CreateNewSend(c, ctx.NodeID, db)
 	if err != nil {
-		return errors.New("Failed to create send request")
+		return griperrors.CreateSendFailed
 	}
 	//Send to all with requests
 	err = SendToAllContextRequests(c, c.ContextDig, db)
@@ -0,0 +1,308 @@
+package grip
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//CAPCONTEXTSYNC the node compares contexts with SyncRoot
+const CAPCONTEXTSYNC string = "context-sync"
+
+//SYNCINTERVAL how often the node that made a connection compares
+//the contexts both nodes are in
+const SYNCINTERVAL time.Duration = 10 * time.Minute
+
+//SYNCBUCKETS digests are put in buckets by their first byte
+const SYNCBUCKETS int = 256
+
+//SYNCHASHSIZE the bytes of each bucket hash that are sent
+const SYNCHASHSIZE int = 16
+
+//SYNCMAXDIGS the most digests in one SyncDigs.  Buckets that do
+//not match are split across as many as it takes.
+const SYNCMAXDIGS int = 4096
+
+//SyncRoot starts a comparison of a context.  Root covers every
+//ContextRequest, ContextResponse and ContextFile digest.
+type SyncRoot struct {
+	Context []byte
+	Root    []byte
+}
+
+//SyncBuckets answers a SyncRoot that does not match with the hash
+//of every bucket
+type SyncBuckets struct {
+	Context []byte
+	Hashes  [][]byte
+}
+
+//SyncDigs the buckets that do not match, and every digest the
+//sending node has in them
+type SyncDigs struct {
+	Context []byte
+	Buckets []byte
+	Digs    [][]byte
+}
+
+//SyncWant asks for records the sending node is missing
+type SyncWant struct {
+	Context []byte
+	Digs    [][]byte
+}
+
+//ContextSummary the digests of a context sorted into buckets
+type ContextSummary struct {
+	Buckets [SYNCBUCKETS][][]byte
+}
+
+//NewContextSummary puts digs in their buckets
+func NewContextSummary(digs [][]byte) *ContextSummary {
+	var s ContextSummary
+	for _, d := range digs {
+		if len(d) > 0 {
+			s.Buckets[d[0]] = append(s.Buckets[d[0]], d)
+		}
+	}
+	for _, b := range s.Buckets {
+		sort.Slice(b, func(i, j int) bool {
+			return bytes.Compare(b[i], b[j]) < 0
+		})
+	}
+	return &s
+}
+
+//Hash of bucket i
+func (s *ContextSummary) Hash(i int) []byte {
+	h := sha512.New()
+	for _, d := range s.Buckets[i] {
+		gripcrypto.HashBytes(h, d)
+	}
+	return h.Sum(nil)[:SYNCHASHSIZE]
+}
+
+//Hashes of every bucket
+func (s *ContextSummary) Hashes() [][]byte {
+	hl := make([][]byte, SYNCBUCKETS)
+	for i := range hl {
+		hl[i] = s.Hash(i)
+	}
+	return hl
+}
+
+//Root the hash of the bucket hashes
+func (s *ContextSummary) Root() []byte {
+	h := sha512.New()
+	for _, b := range s.Hashes() {
+		gripcrypto.HashBytes(h, b)
+	}
+	return h.Sum(nil)[:SYNCHASHSIZE]
+}
+
+//Diff the buckets that do not match hl
+func (s *ContextSummary) Diff(hl [][]byte) []byte {
+	var d []byte
+	for i := 0; i < SYNCBUCKETS; i++ {
+		if i >= len(hl) || !bytes.Equal(hl[i], s.Hash(i)) {
+			d = append(d, byte(i))
+		}
+	}
+	return d
+}
+
+//Digs every digest in the buckets bl
+func (s *ContextSummary) Digs(bl []byte) [][]byte {
+	var dl [][]byte
+	for _, b := range bl {
+		dl = append(dl, s.Buckets[b]...)
+	}
+	return dl
+}
+
+//Split bl into groups of buckets with at most max digests between
+//them.  A bucket with more than max is a group on its own.
+func (s *ContextSummary) Split(bl []byte, max int) [][]byte {
+	var gl [][]byte
+	var g []byte
+	n := 0
+	for _, b := range bl {
+		if len(g) > 0 && n+len(s.Buckets[b]) > max {
+			gl = append(gl, g)
+			g = nil
+			n = 0
+		}
+		g = append(g, b)
+		n += len(s.Buckets[b])
+	}
+	if len(g) > 0 {
+		gl = append(gl, g)
+	}
+	return gl
+}
+
+//ContextDigests every ContextRequest, ContextResponse and
+//ContextFile digest we have for the context.  Deleted ContextFiles
+//are included so they are not sent to us again.
+func ContextDigests(cid []byte, db DB) [][]byte {
+	var dl [][]byte
+	for _, r := range db.GetContextRequests(cid) {
+		dl = append(dl, r.Dig)
+	}
+	for _, r := range db.GetContextResponses(cid) {
+		dl = append(dl, r.Dig)
+	}
+	for _, f := range db.GetContextFiles(cid) {
+		dl = append(dl, f.ContextFile.Dig)
+	}
+	for _, f := range db.GetContextFilesDeleted(cid) {
+		dl = append(dl, f.Dig)
+	}
+	return dl
+}
+
+//IsContextMember true if the node created the context or has a
+//ContextRequest for it.  Members get a context's requests and
+//responses, only participants with a response get its files.
+func IsContextMember(cid []byte, id []byte, db DB) bool {
+	ctx := db.GetContext(cid)
+	if ctx == nil {
+		return false
+	}
+	return bytes.Equal(ctx.NodeID, id) || db.GetContextRequest(cid, id) != nil
+}
+
+func isContextParticipant(ctx *gripdata.Context, id []byte, db DB) bool {
+	return bytes.Equal(ctx.NodeID, id) || filterContextRequest(db.GetContextRequest(ctx.Dig, id), db) != nil
+}
+
+//canSync true if both nodes are members of the context
+func (ctrl *ConnectionController) canSync(cid []byte) bool {
+	myn, _ := ctrl.DB.GetPrivateNodeData()
+	return IsContextMember(cid, myn.ID, ctrl.DB) && IsContextMember(cid, ctrl.C.GetNodeID(), ctrl.DB)
+}
+
+//syncContexts sends a SyncRoot for every context both nodes are
+//members of.  Only the node that made the connection does, once
+//it has the Introduction and then every SyncInterval.
+func (ctrl *ConnectionController) syncContexts() error {
+	if ctrl.Incoming || ctrl.SocketCtrl == nil || !ctrl.HasFeature(CAPCONTEXTSYNC) {
+		return nil
+	}
+	iv := ctrl.SocketCtrl.SyncInterval
+	if iv <= 0 || time.Since(ctrl.lastSync) < iv {
+		return nil
+	}
+	ctrl.lastSync = time.Now()
+	myn, _ := ctrl.DB.GetPrivateNodeData()
+	for _, cid := range ctrl.DB.GetNodeContexts(myn.ID) {
+		if !IsContextMember(cid, ctrl.C.GetNodeID(), ctrl.DB) {
+			continue
+		}
+		var r SyncRoot
+		r.Context = cid
+		r.Root = NewContextSummary(ContextDigests(cid, ctrl.DB)).Root()
+		err := ctrl.C.Send(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctrl *ConnectionController) syncRoot(v SyncRoot) {
+	if !ctrl.canSync(v.Context) {
+		return
+	}
+	s := NewContextSummary(ContextDigests(v.Context, ctrl.DB))
+	if !bytes.Equal(s.Root(), v.Root) {
+		ctrl.queueSend(SyncBuckets{Context: v.Context, Hashes: s.Hashes()})
+	}
+}
+
+func (ctrl *ConnectionController) syncBuckets(v SyncBuckets) {
+	if !ctrl.canSync(v.Context) {
+		return
+	}
+	s := NewContextSummary(ContextDigests(v.Context, ctrl.DB))
+	for _, bl := range s.Split(s.Diff(v.Hashes), SYNCMAXDIGS) {
+		ctrl.queueSend(SyncDigs{Context: v.Context, Buckets: bl, Digs: s.Digs(bl)})
+	}
+}
+
+//syncDigs the records only we have are sent, the ones only the
+//other node has are asked for
+func (ctrl *ConnectionController) syncDigs(v SyncDigs) {
+	if !ctrl.canSync(v.Context) {
+		return
+	}
+	s := NewContextSummary(ContextDigests(v.Context, ctrl.DB))
+	theirs := make(map[string]bool)
+	for _, d := range v.Digs {
+		theirs[base64.StdEncoding.EncodeToString(d)] = true
+	}
+	mine := make(map[string]bool)
+	for _, d := range s.Digs(v.Buckets) {
+		ds := base64.StdEncoding.EncodeToString(d)
+		mine[ds] = true
+		if !theirs[ds] {
+			ctrl.syncRecord(v.Context, d)
+		}
+	}
+	var w SyncWant
+	w.Context = v.Context
+	for _, d := range v.Digs {
+		if !mine[base64.StdEncoding.EncodeToString(d)] {
+			w.Digs = append(w.Digs, d)
+		}
+	}
+	if len(w.Digs) > 0 {
+		ctrl.queueSend(w)
+	}
+}
+
+func (ctrl *ConnectionController) syncWant(v SyncWant) {
+	if !ctrl.canSync(v.Context) {
+		return
+	}
+	for _, d := range v.Digs {
+		ctrl.syncRecord(v.Context, d)
+	}
+}
+
+//syncRecord sends a record of the context to the other node the
+//way it would have been sent the first time.  ContextFiles only
+//go to participants, and not once we have deleted them.
+func (ctrl *ConnectionController) syncRecord(cid []byte, d []byte) {
+	id := ctrl.C.GetNodeID()
+	var rec gripcrypto.SignInf
+	switch v := ctrl.DB.GetDigestData(d).(type) {
+	case *gripdata.ContextRequest:
+		if bytes.Equal(v.ContextDig, cid) {
+			rec = v
+		}
+	case *gripdata.ContextResponse:
+		if bytes.Equal(v.ContextDig, cid) {
+			rec = v
+		}
+	case *gripdata.ContextFile:
+		ctx := ctrl.DB.GetContext(cid)
+		if bytes.Equal(v.Context, cid) && ctrl.DB.GetContextFileDeleted(d) == nil && isContextParticipant(ctx, id, ctrl.DB) {
+			rec = v
+		}
+	}
+	if rec == nil {
+		return
+	}
+	//It may have been offered and acknowledged before it was lost
+	ctrl.unseen(d)
+	err := CreateNewSend(rec, id, ctrl.DB)
+	if err != nil {
+		log.Printf("Failed to send context record: %s", err)
+	}
+}
@@ -15,6 +15,8 @@ type Accountdb interface {
 	CheckUpdateStorageUsed(a *gripdata.Account, fsize uint64) error
 	FreeStorageUsed(a *gripdata.Account, fsize uint64) (*gripdata.Account, error)
 	SetAccountMessage(a *gripdata.Account, msg string) error
+	//Add n to RelayBytesUsed, fail if it would exceed MaxRelayBytes
+	CheckUpdateRelayUsed(a *gripdata.Account, n uint64) error
 }
 
 //Nodedb used for storing/getting node data from db
@@ -30,12 +32,21 @@ type Nodedb interface {
 	StoreUseShareNodeKey(k *gripdata.UseShareNodeKey) error
 	ListUseShareNodeKey(k string) []gripdata.UseShareNodeKey //List all that have used key
 	StoreAssociateNodeAccountKey(n *gripdata.AssociateNodeAccountKey) error
+	//Set NodeEphemera.LastAddress, no error if missing
+	SetNodeEphemeraAddress(id []byte, url string) error
 }
 
 //Netdb used for network db access
 type Netdb interface {
+	//Keep one SendData per Dig and TargetID.  If s.Dig is already
+	//waiting for s.TargetID do nothing and return nil, records are
+	//queued for a node from more than one place.
 	StoreSendData(s *gripdata.SendData) error
 	StoreRejectedSendData(s *gripdata.RejectedSendData) error
+	//List rejected data, a nil target or empty typename matches any
+	ListRejectedSendData(target []byte, typename string) []gripdata.RejectedSendData
+	//No error if missing
+	DeleteRejectedSendData(d []byte, target []byte) error
 	//get all send data for target node, must be sorted by Timestamp
 	GetSendData(target []byte, max int) []gripdata.SendData
 	//Data has been setnt to the node, no error if missing
@@ -47,6 +58,11 @@ type Netdb interface {
 	//NodeEphemera.NextAttempt <= curtime
 	//exists some SendData.TargetID == NodeEphemera.ID
 	GetConnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera
+	//NodeEphemera.Connectable == false
+	//NodeEphemera.Connected == false
+	//NodeEphemera.NextAttempt <= curtime
+	//exists some SendData.TargetID == NodeEphemera.ID
+	GetUnconnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera
 	//Get nodes that are connectable that we have sent a ShareNodeInfo with a Key,
 	//So we can get new UseShareNodeKeys that may have been submitted to that node.
 	GetConnectableNodesWithShareNodeKey(max int, curtime uint64) []gripdata.NodeEphemera
@@ -59,8 +75,12 @@ type Netdb interface {
 	GetAllConnected() []gripdata.NodeEphemera
 	CreateNodeEphemera(id []byte, connectable bool) error
 	SetNodeEphemeraNextConnection(id []byte, last uint64, next uint64) error
+	//Add one to ConnFailures, and set LastConnAttempt to last,
+	//NextAttempt to next, and ConnectionPending false
+	SetNodeEphemeraFailed(id []byte, last uint64, next uint64) error
 	ClearAllConnected()
 	CanNodeEphemeraGoPending(id []byte) bool
+	//Must also set ConnFailures to zero
 	SetNodeEphemeraConnected(incomming bool, id []byte, curtime uint64) error
 	SetNodeEphemeraClosed(id []byte) error
 	//Get all the ContextRequest/ContextResponse pairs for this node
@@ -99,6 +119,10 @@ type Contextdb interface {
 	GetContextLeaves(cid []byte, covered bool, index bool) []*gripdata.ContextFileWrap
 	//Sort by depth and size
 	GetCoveredSnapshots(cid []byte) []*gripdata.ContextFileWrap
+	//Digests of the contexts the node created or has a ContextRequest for
+	GetNodeContexts(id []byte) [][]byte
+	GetContextFiles(cid []byte) []*gripdata.ContextFileWrap
+	GetContextFilesDeleted(cid []byte) []*gripdata.DeletedContextFile
 }
 
 //NodeContextdb implements both Nodedb and Contextdb
@@ -133,10 +157,43 @@ type NodeNetAccountdb interface {
 	Accountdb
 }
 
+//Maildb holds records for other nodes while they are offline
+type Maildb interface {
+	//Fail if there is already Mail with the same To and Dig
+	StoreMail(m *gripdata.Mail) error
+	GetMail(to []byte, dig []byte) *gripdata.Mail
+	//Mail for to not yet Delivered, must be sorted by Timestamp
+	ListMail(to []byte, max int) []gripdata.Mail
+	//Set Delivered, Message and Code and drop the Data, nil if
+	//not found or already Delivered
+	SetMailDelivered(to []byte, dig []byte, msg string, code int) (*gripdata.Mail, error)
+	//Delivered Mail left by from, so it can be told
+	ListMailDelivered(from []byte, max int) []gripdata.Mail
+	//No error if missing
+	DeleteMail(to []byte, dig []byte) error
+	//Replace any with the same Mailbox, To and Dig
+	StoreMailDeposited(d *gripdata.MailDeposited) error
+	GetMailDeposited(mailbox []byte, to []byte, dig []byte) *gripdata.MailDeposited
+	//No error if missing
+	DeleteMailDeposited(mailbox []byte, to []byte, dig []byte) error
+}
+
+//Seendb is optional.  If the DB implements it the seen digest
+//cache is kept across restarts.  What the cache forgets is
+//deleted, so it holds no more than the cache does.
+type Seendb interface {
+	StoreSeenDig(s *gripdata.SeenDig) error
+	//The newest max, oldest first
+	ListSeenDigs(max int) []gripdata.SeenDig
+	//A nil node deletes dig for every node.  No error if missing.
+	DeleteSeenDig(dig []byte, node []byte) error
+}
+
 //DB implements all database interfaces
 type DB interface {
 	Nodedb
 	Netdb
 	Contextdb
 	Accountdb
+	Maildb
 }
@@ -0,0 +1,219 @@
+package grip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"log"
+	"net"
+	"time"
+
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//DISCOVERYADDR the multicast group nodes announce themselves on
+const DISCOVERYADDR string = "239.255.71.73:7173"
+
+//DISCOVERYINTERVAL how often we announce ourselves
+const DISCOVERYINTERVAL time.Duration = 30 * time.Second
+
+//DISCOVERYMAXAGE how far an announcement's Timestamp may be from
+//our clock.  Older announcements may be replayed.
+const DISCOVERYMAXAGE time.Duration = 2 * time.Minute
+
+//DISCOVERYMAXSIZE the largest announcement we read
+const DISCOVERYMAXSIZE int = 8192
+
+//DiscoveryAnnounce is multicast on the local network.  KeyHash
+//tells nodes with other keys to ignore it, MAC shows the sender
+//knows the key.
+type DiscoveryAnnounce struct {
+	Node      *gripdata.Node
+	KeyHash   []byte
+	Timestamp uint64
+	MAC       []byte
+}
+
+//Discovery finds nodes on the local network that know the same
+//discovery key.  The key is also used as a ShareNodeKey, so the
+//nodes that find each other can share without copying node ids.
+type Discovery struct {
+	Key      string
+	Addr     string        //Multicast group, DISCOVERYADDR by default
+	Interval time.Duration //How often to announce, DISCOVERYINTERVAL by default
+	hash     []byte
+}
+
+//NewDiscovery builds a Discovery for key
+func NewDiscovery(key string) *Discovery {
+	var d Discovery
+	d.Key = key
+	d.Addr = DISCOVERYADDR
+	d.Interval = DISCOVERYINTERVAL
+	h := sha512.New()
+	gripcrypto.HashString(h, "grip discovery:")
+	gripcrypto.HashString(h, key)
+	d.hash = h.Sum(nil)
+	return &d
+}
+
+func (d *Discovery) mac(a *DiscoveryAnnounce) []byte {
+	h := hmac.New(sha512.New, []byte(d.Key))
+	gripcrypto.HashBytes(h, a.Node.Dig)
+	gripcrypto.HashBytes(h, a.KeyHash)
+	gripcrypto.HashUint64(h, a.Timestamp)
+	return h.Sum(nil)
+}
+
+//NewAnnouncement announces n as of ts
+func (d *Discovery) NewAnnouncement(n *gripdata.Node, ts uint64) DiscoveryAnnounce {
+	var a DiscoveryAnnounce
+	a.Node = n
+	a.KeyHash = d.hash
+	a.Timestamp = ts
+	a.MAC = d.mac(&a)
+	return a
+}
+
+//Announce the encoded announcement for our node
+func (d *Discovery) Announce(db DB) ([]byte, error) {
+	myn, _ := db.GetPrivateNodeData()
+	return EncodeMessage(d.NewAnnouncement(myn, uint64(time.Now().UnixNano())))
+}
+
+//Incoming processes an announcement read from the network.  It
+//returns the node announced, or nil if the announcement is ours
+//or for another key.  A new node is stored like one we connected
+//to, given an account if AutoCreateShareAccount is set, and we
+//use the key with it so it shares with us.  We share with the
+//nodes that use the key with us through our own ShareNodeInfo
+//for the key.
+func (d *Discovery) Incoming(b []byte, db DB) (*gripdata.Node, error) {
+	m, err := DecodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := m.(DiscoveryAnnounce)
+	if !ok || a.Node == nil {
+		return nil, griperrors.DiscoveryInvalid
+	}
+	if !bytes.Equal(a.KeyHash, d.hash) {
+		return nil, nil
+	}
+	if !hmac.Equal(a.MAC, d.mac(&a)) {
+		return nil, griperrors.DiscoveryInvalid
+	}
+	now := uint64(time.Now().UnixNano())
+	age := now - a.Timestamp
+	if a.Timestamp > now {
+		age = a.Timestamp - now
+	}
+	if time.Duration(age) > DISCOVERYMAXAGE {
+		return nil, griperrors.DiscoveryStale
+	}
+	myn, mypr := db.GetPrivateNodeData()
+	if bytes.Equal(myn.ID, a.Node.ID) {
+		return nil, nil
+	}
+	kn := db.GetNode(a.Node.ID)
+	if kn == nil || !bytes.Equal(kn.Dig, a.Node.Dig) {
+		err = IncomingNode(a.Node, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	createAutoAccount(mypr, a.Node.ID, db)
+	err = d.shareNode(myn.ID, a.Node.ID, db)
+	if err != nil {
+		return nil, err
+	}
+	return a.Node, d.useKey(myn.ID, a.Node.ID, db)
+}
+
+//shareNode creates our ShareNodeInfo for the key, for the first
+//node we discover, unless we already have one
+func (d *Discovery) shareNode(myid []byte, target []byte, db DB) error {
+	for _, s := range db.ListShareNodeInfo(myid) {
+		if s.Key == d.Key {
+			return nil
+		}
+	}
+	var s gripdata.ShareNodeInfo
+	s.Key = d.Key
+	s.TargetNodeID = target
+	//Without MetaData it has the same digest as our
+	//UseShareNodeKey for target
+	s.MetaData = "discovery"
+	return NewShareNode(&s, db)
+}
+
+//useKey sends a UseShareNodeKey to target unless we already have
+func (d *Discovery) useKey(myid []byte, target []byte, db DB) error {
+	for _, u := range db.ListUseShareNodeKey(d.Key) {
+		if bytes.Equal(u.NodeID, myid) && bytes.Equal(u.TargetID, target) {
+			return nil
+		}
+	}
+	var u gripdata.UseShareNodeKey
+	u.Key = d.Key
+	u.TargetID = target
+	return NewUseShareNodeKey(&u, db)
+}
+
+//discoverRoutine reads announcements until we close
+func (s *SocketController) discoverRoutine() {
+	d := s.Discovery
+	ga, err := net.ResolveUDPAddr("udp", d.Addr)
+	if err != nil {
+		log.Printf("Bad discovery address %s: %s", d.Addr, err)
+		return
+	}
+	l, err := net.ListenMulticastUDP("udp", nil, ga)
+	if err != nil {
+		log.Printf("Failed to listen for discovery: %s", err)
+		return
+	}
+	s.goRoutine("announce", func() {
+		s.announceRoutine(ga)
+		l.Close()
+	})
+	b := make([]byte, DISCOVERYMAXSIZE)
+	for {
+		n, _, err := l.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		nd, err := d.Incoming(b[:n], s.DB)
+		if err != nil {
+			log.Printf("Discovery announcement rejected: %s", err)
+		} else if nd != nil {
+			s.Orphans.landed(landedKeys(nd))
+		}
+	}
+}
+
+//announceRoutine announces our node every Interval until we close
+func (s *SocketController) announceRoutine(ga *net.UDPAddr) {
+	d := s.Discovery
+	c, err := net.DialUDP("udp", nil, ga)
+	if err != nil {
+		log.Printf("Failed to announce for discovery: %s", err)
+		<-s.closing
+		return
+	}
+	defer c.Close()
+	for {
+		b, err := d.Announce(s.DB)
+		if err == nil {
+			_, err = c.Write(b)
+		}
+		if err != nil {
+			log.Printf("Failed to announce: %s", err)
+		}
+		if !s.sleep(d.Interval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package grip
+
+import (
+	"bytes"
+	"os"
+)
+
+//fileLane streams the data behind one ContextFile.  It only
+//sends as many chunks as the other node asked for.
+type fileLane struct {
+	dig    []byte
+	f      *os.File
+	size   uint64
+	off    uint64
+	credit uint32
+}
+
+//FileLanes are the file streams on a connection.  The write
+//routine takes one chunk at a time from them, in turn, and
+//checks for control messages between every chunk, so file data
+//never holds up anything else.
+type FileLanes struct {
+	lanes []*fileLane
+	next  int
+}
+
+//Active true if any lane has a chunk to send
+func (l *FileLanes) Active() bool {
+	return len(l.lanes) > 0
+}
+
+func (l *FileLanes) find(dig []byte) int {
+	for i, ln := range l.lanes {
+		if bytes.Equal(ln.dig, dig) {
+			return i
+		}
+	}
+	return -1
+}
+
+//Grant lets r.Window more chunks of the file at path be sent,
+//starting at r.Offset
+func (l *FileLanes) Grant(r FileChunkReq, path string, size uint64) error {
+	w := r.Window
+	if w == 0 || w > FILECHUNKWINDOW {
+		w = FILECHUNKWINDOW
+	}
+	i := l.find(r.Dig)
+	if i >= 0 {
+		l.lanes[i].off = r.Offset
+		l.lanes[i].credit = w
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	l.lanes = append(l.lanes, &fileLane{dig: r.Dig, f: f, size: size, off: r.Offset, credit: w})
+	return nil
+}
+
+func (l *FileLanes) remove(i int) {
+	l.lanes[i].f.Close()
+	l.lanes = append(l.lanes[:i], l.lanes[i+1:]...)
+	if l.next > i {
+		l.next--
+	}
+}
+
+//Next the next chunk to send, nil if nothing is waiting
+func (l *FileLanes) Next() (*FileChunk, error) {
+	if len(l.lanes) == 0 {
+		return nil, nil
+	}
+	if l.next >= len(l.lanes) {
+		l.next = 0
+	}
+	i := l.next
+	ln := l.lanes[i]
+	ch, err := readFileChunk(ln.f, ln.dig, ln.off, ln.size)
+	if err != nil {
+		l.remove(i)
+		return nil, err
+	}
+	ln.off += uint64(len(ch.Data))
+	ln.credit--
+	if ch.Last || ln.credit == 0 {
+		l.remove(i)
+	} else {
+		l.next = i + 1
+	}
+	return &ch, nil
+}
+
+//Close all the lanes
+func (l *FileLanes) Close() {
+	for len(l.lanes) > 0 {
+		l.remove(0)
+	}
+}
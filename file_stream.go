@@ -0,0 +1,241 @@
+package grip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//PARTSUFFIX is added to the data path of a ContextFile
+//while its data is still being received
+const PARTSUFFIX string = ".part"
+
+//NodeDataDir where this node keeps file data it gets from
+//other nodes
+func NodeDataDir(pr *gripdata.MyNodePrivateData) string {
+	if pr.DataDir != "" {
+		return pr.DataDir
+	}
+	return filepath.Join(os.TempDir(), "grip", hex.EncodeToString(pr.ID[:8]))
+}
+
+//ContextFileDataPath where the data for a ContextFile from
+//another node is kept
+func ContextFileDataPath(pr *gripdata.MyNodePrivateData, c *gripdata.ContextFile) string {
+	return filepath.Join(NodeDataDir(pr), hex.EncodeToString(c.Dig))
+}
+
+//serveFileChunks is a FileChunkReq from the other node for
+//the write routine to answer.  Our own FileChunkReqs are
+//just sent.
+type serveFileChunks FileChunkReq
+
+//fileDownload is a ContextFile whose data we are receiving
+type fileDownload struct {
+	cf   *gripdata.ContextFile
+	part string
+	f    *os.File
+	size uint64 //Bytes in the part file
+	end  uint64 //The end of the chunks we asked for
+}
+
+func (ctrl *ConnectionController) incomingContextFile(v *gripdata.ContextFile) {
+	//Never change the sending node's copy
+	cf := *v
+	need, err := NeedContextFileData(&cf, ctrl.DB)
+	if err == nil && need {
+		err = ctrl.startDownload(&cf)
+		if err == nil {
+			//Ack or reject once we have the data
+			return
+		}
+	}
+	if err == nil {
+		err = IncomingContextFile(&cf, ctrl.DB)
+	} else if ctrl.holdOrphan("ContextFile", v, cf.Dig, err) {
+		return
+	}
+	ctrl.processSendError("ContextFile", cf.Dig, err)
+}
+
+//startDownload picks up from whatever is already in the part
+//file, so a dropped connection does not start over from zero
+func (ctrl *ConnectionController) startDownload(cf *gripdata.ContextFile) error {
+	key := base64.StdEncoding.EncodeToString(cf.Dig)
+	if ctrl.downloads[key] != nil || ctrl.SocketCtrl == nil {
+		return nil
+	}
+	part := cf.GetPath() + PARTSUFFIX
+	if !ctrl.SocketCtrl.claimDownload(part) {
+		//Another connection is getting it.  We will
+		//be offered it again if that one fails.
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(part), 0700)
+	if err != nil {
+		ctrl.SocketCtrl.releaseDownload(part)
+		return err
+	}
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		ctrl.SocketCtrl.releaseDownload(part)
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		ctrl.SocketCtrl.releaseDownload(part)
+		return err
+	}
+	d := &fileDownload{cf: cf, part: part, f: f, size: uint64(st.Size())}
+	if d.size > cf.Size {
+		f.Truncate(0)
+		d.size = 0
+	}
+	ctrl.downloads[key] = d
+	ctrl.requestChunks(d)
+	return nil
+}
+
+func (ctrl *ConnectionController) requestChunks(d *fileDownload) {
+	var r FileChunkReq
+	r.Dig = d.cf.Dig
+	r.Offset = d.size
+	r.Window = FILECHUNKWINDOW
+	d.end = d.size + uint64(FILECHUNKWINDOW)*uint64(FILECHUNKSIZE)
+	ctrl.queueSend(r)
+}
+
+func (ctrl *ConnectionController) fileChunk(v FileChunk) {
+	d := ctrl.downloads[base64.StdEncoding.EncodeToString(v.Dig)]
+	if d == nil || v.Offset != d.size {
+		//Left over from a window we no longer want
+		return
+	}
+	if d.size+uint64(len(v.Data)) > d.cf.Size {
+		ctrl.failDownload(d, griperrors.InvalidFileSize)
+		return
+	}
+	_, err := d.f.WriteAt(v.Data, int64(d.size))
+	if err != nil {
+		log.Printf("Failed to write file data: %s", err)
+		ctrl.endDownload(d)
+		return
+	}
+	d.size += uint64(len(v.Data))
+	if v.Last {
+		ctrl.finishDownload(d)
+	} else if d.size >= d.end {
+		ctrl.requestChunks(d)
+	}
+}
+
+//verifyFileData check the data in p is what the ContextFile signed
+func verifyFileData(cf *gripdata.ContextFile, p string) error {
+	chk := *cf
+	chk.SetPath(p)
+	chk.Digest()
+	if !bytes.Equal(chk.DataDepDig, cf.DataDepDig) {
+		return griperrors.FileDataMismatch
+	}
+	return nil
+}
+
+func (ctrl *ConnectionController) finishDownload(d *fileDownload) {
+	ctrl.endDownload(d)
+	err := verifyFileData(d.cf, d.part)
+	if err != nil {
+		ctrl.failDownload(d, err)
+		return
+	}
+	err = os.Rename(d.part, d.cf.GetPath())
+	if err == nil {
+		err = IncomingContextFile(d.cf, ctrl.DB)
+	}
+	ctrl.processSendError("ContextFile", d.cf.Dig, err)
+}
+
+func (ctrl *ConnectionController) failDownload(d *fileDownload, err error) {
+	ctrl.endDownload(d)
+	os.Remove(d.part)
+	ctrl.processSendError("ContextFile", d.cf.Dig, err)
+}
+
+func (ctrl *ConnectionController) endDownload(d *fileDownload) {
+	key := base64.StdEncoding.EncodeToString(d.cf.Dig)
+	if ctrl.downloads[key] == d {
+		delete(ctrl.downloads, key)
+		d.f.Close()
+		if ctrl.SocketCtrl != nil {
+			ctrl.SocketCtrl.releaseDownload(d.part)
+		}
+	}
+}
+
+//closeDownloads leaves the part files so the next
+//connection can resume them
+func (ctrl *ConnectionController) closeDownloads() {
+	for _, d := range ctrl.downloads {
+		d.f.Close()
+		if ctrl.SocketCtrl != nil {
+			ctrl.SocketCtrl.releaseDownload(d.part)
+		}
+	}
+	ctrl.downloads = make(map[string]*fileDownload)
+}
+
+func readFileChunk(f *os.File, dig []byte, off uint64, size uint64) (FileChunk, error) {
+	var c FileChunk
+	c.Dig = dig
+	c.Offset = off
+	n := uint64(FILECHUNKSIZE)
+	if off >= size {
+		n = 0
+	} else if size-off < n {
+		n = size - off
+	}
+	c.Data = make([]byte, n)
+	_, err := f.ReadAt(c.Data, int64(off))
+	if err != nil && n > 0 {
+		return c, err
+	}
+	c.Last = off+n >= size
+	return c, nil
+}
+
+//grantFileChunks opens a file lane for the chunks asked for.
+//Problems with the file are only logged, the other node will
+//ask again later.
+func (ctrl *ConnectionController) grantFileChunks(r FileChunkReq) {
+	cf, ok := ctrl.DB.GetDigestData(r.Dig).(*gripdata.ContextFile)
+	if !ok || cf == nil {
+		log.Printf("Asked for data of unknown file")
+		return
+	}
+	err := ctrl.Lanes.Grant(r, cf.GetPath(), cf.Size)
+	if err != nil {
+		log.Printf("Failed to open file data: %s", err)
+	}
+}
+
+//sendFileChunk send the next chunk from the file lanes
+func (ctrl *ConnectionController) sendFileChunk() error {
+	if !ctrl.waitForFileTokens() {
+		return nil
+	}
+	ch, err := ctrl.Lanes.Next()
+	if err != nil {
+		log.Printf("Failed to read file data: %s", err)
+		return nil
+	}
+	if ch == nil {
+		return nil
+	}
+	return ctrl.sendCounted(ctrl.compressFileChunk(*ch))
+}
@@ -102,24 +102,38 @@ func HashFile(h hash.Hash, f string) {
 	}
 }
 
-//ReadInt read int from slice
-func ReadInt(s []byte) (int, int) {
-	bl := int(binary.BigEndian.Uint64(s[0:8]))
-	return bl, 8
+//ReadInt read int from slice.  ok is false if s is too short.
+func ReadInt(s []byte) (int, int, bool) {
+	if len(s) < 8 {
+		return 0, 0, false
+	}
+	bl := binary.BigEndian.Uint64(s[0:8])
+	if bl > uint64(len(s)) {
+		return 0, 8, false
+	}
+	return int(bl), 8, true
 }
 
-//ReadBytes read a slice from a slice
-func ReadBytes(s []byte) ([]byte, int) {
-	l, il := ReadInt(s)
-	return s[il:(l + il)], l + il
+//ReadBytes read a slice from a slice.  ok is false if the length
+//does not fit in s.
+func ReadBytes(s []byte) ([]byte, int, bool) {
+	l, il, ok := ReadInt(s)
+	if !ok || l > len(s)-il {
+		return nil, 0, false
+	}
+	return s[il:(l + il)], l + il, true
 }
 
-//ReadBigInt read big int from a slice
-func ReadBigInt(s []byte) (*big.Int, int) {
-	bs, bl := ReadBytes(s)
+//ReadBigInt read big int from a slice.  ok is false if the length
+//does not fit in s.
+func ReadBigInt(s []byte) (*big.Int, int, bool) {
+	bs, bl, ok := ReadBytes(s)
+	if !ok {
+		return nil, 0, false
+	}
 	bo := big.NewInt(0)
 	bo = bo.SetBytes(bs)
-	return bo, bl
+	return bo, bl, true
 }
 
 //PrepareBigInt prepare to read big int from slice
@@ -164,6 +178,9 @@ func GenerateECDSAKeyPair() (prv, pub []byte, e error) {
 
 //Verify verifies a signature
 func Verify(g SignInf, pk []byte) bool {
+	if len(pk) < MODELEN || len(g.GetSig()) < MODELEN {
+		return false
+	}
 	idx := 0
 	ek := binary.BigEndian.Uint64(pk[idx:MODELEN])
 	idx += MODELEN
@@ -171,19 +188,25 @@ func Verify(g SignInf, pk []byte) bool {
 	ek2 := binary.BigEndian.Uint64(sig[0:MODELEN])
 	if ek == ECDSAMODEP521 && ek2 == ECDSAMODEP521 {
 		//This is NOT on safecurve list.  FIXME!  Implement something better
-		var x, y *big.Int
-		var nx int
-		x, nx = ReadBigInt(pk[idx:])
+		x, nx, okx := ReadBigInt(pk[idx:])
 		idx += nx
-		y, nx = ReadBigInt(pk[idx:])
+		y, _, oky := ReadBigInt(pk[idx:])
+		if !okx || !oky {
+			return false
+		}
 		cv := elliptic.P521()
+		if !cv.IsOnCurve(x, y) {
+			return false
+		}
 		p := ecdsa.PublicKey{Curve: cv, X: x, Y: y}
 		//Get sig big.Ints
 		idx = MODELEN
-		var r, s *big.Int
-		r, nx = ReadBigInt(sig[idx:])
+		r, nx, okr := ReadBigInt(sig[idx:])
 		idx += nx
-		s, nx = ReadBigInt(sig[idx:])
+		s, _, oks := ReadBigInt(sig[idx:])
+		if !okr || !oks {
+			return false
+		}
 		return ecdsa.Verify(&p, g.Digest(), r, s)
 	}
 	return false
@@ -191,13 +214,14 @@ func Verify(g SignInf, pk []byte) bool {
 
 func ECDSASign(g SignInf, pk []byte, idx int) error {
 	//This is NOT on safecurve list.  FIXME!  Implement something better
-	var x, y, d *big.Int
-	var nx int
-	x, nx = ReadBigInt(pk[idx:])
+	x, nx, okx := ReadBigInt(pk[idx:])
 	idx += nx
-	y, nx = ReadBigInt(pk[idx:])
+	y, nx, oky := ReadBigInt(pk[idx:])
 	idx += nx
-	d, nx = ReadBigInt(pk[idx:])
+	d, _, okd := ReadBigInt(pk[idx:])
+	if !okx || !oky || !okd {
+		return errors.New("Invalid private key")
+	}
 	cv := elliptic.P521()
 	p := ecdsa.PublicKey{Curve: cv, X: x, Y: y}
 	pv := ecdsa.PrivateKey{PublicKey: p, D: d}
@@ -223,6 +247,9 @@ func ECDSASign(g SignInf, pk []byte, idx int) error {
 
 //Sign signs a sign interface
 func Sign(g SignInf, pk []byte) error {
+	if len(pk) < MODELEN {
+		return errors.New("Invalid private key")
+	}
 	idx := 0
 	ek := binary.BigEndian.Uint64(pk[idx:MODELEN])
 	idx += MODELEN
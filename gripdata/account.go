@@ -20,6 +20,8 @@ type Account struct {
 	AllowNodeAcocuntKey bool   //Allow use of NodeAccountKeys to assocate with this account
 	AllowNewLogin       bool   //Allow nodes to create new logins for contexts
 	AllowCacheMode      uint32 //Which cache modes are available
+	MaxRelayBytes       uint64 //Most bytes we relay for this account, zero for none
+	MaxSendRate         uint64 //Bytes per second we send to this account's nodes, zero for no limit
 
 	Message string //Message to present to to the account user
 	Enabled bool   //Is this account enabled
@@ -27,6 +29,7 @@ type Account struct {
 	NumberNodes    uint32 //Current number of nodes associated with this account
 	NumberContexts uint32 //Current number of contexts created by this account
 	DiskSpaceUsed  uint64 //Current disk space used
+	RelayBytesUsed uint64 //Bytes we have relayed for this account
 }
 
 func (a *Account) Free() uint64 {
@@ -0,0 +1,24 @@
+package gripdata
+
+//Mail is a record a mailbox node holds for another node
+//while it is offline
+type Mail struct {
+	To        []byte //The node the record is for
+	From      []byte //The node that left it with us
+	Dig       []byte //The digest of the record
+	Data      []byte //The encoded record, dropped once delivered
+	Size      uint64 //Bytes charged to the To node's Account
+	Timestamp uint64 //The time this was created
+	Delivered bool   //The To node has acknowledged it
+	Message   string //Why the To node rejected it
+	Code      int    //griperrors code for why, zero if it has none
+}
+
+//MailDeposited is a record we left with a mailbox.  Only that
+//mailbox may tell us it was delivered.
+type MailDeposited struct {
+	Mailbox   []byte //The node holding the record
+	To        []byte //The node the record is for
+	Dig       []byte //The digest of the record
+	Timestamp uint64 //The time it was left
+}
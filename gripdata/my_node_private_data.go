@@ -8,6 +8,7 @@ type MyNodePrivateData struct {
 	BindPort          uint32 //listen port to use
 	PrivateKey        []byte
 	PrivateMetaData   string //Extra private generic metadata
+	DataDir           string //Where file data from other nodes is kept
 	AutoShareNodeInfo bool
 	AutoShareMetaData string
 
@@ -20,7 +21,8 @@ type MyNodePrivateData struct {
 	AutoAccountAllowNodeAcocuntKey bool   //Allow use of NodeAccountKeys to assocate with this account
 	AutoAccountAllowCacheMode      uint32 //Which cache modes are available
 
-	AutoContextResponse bool //Automatically reply to context requests
+	AutoContextResponse bool   //Automatically reply to context requests
+	Locale              string //Language to show other nodes' messages in, en-us if empty
 	//The account data specifies how we respond to a node's request
 
 }
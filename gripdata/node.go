@@ -12,11 +12,20 @@ type Node struct {
 	ID          []byte //Unique id for the node (digest of public key)
 	Name        string
 	PublicKey   []byte
-	URL         string //where we can find this node
-	Connectable bool   //Can we directly connect to it
-	MetaData    string //Generic metadata string
-	Dig         []byte //Digest of all data
-	Sig         []byte //Signed private key of this node
+	URL         string        //where we can find this node
+	Addresses   []NodeAddress //More places to find this node
+	Connectable bool          //Can we directly connect to it
+	MetaData    string        //Generic metadata string
+	Seq         uint64        //Larger for every new version of the node
+	Dig         []byte        //Digest of all data
+	Sig         []byte        //Signed private key of this node
+}
+
+//NodeAddress is one endpoint a node can be reached at.  Lower
+//Priority addresses are tried first.
+type NodeAddress struct {
+	URL      string
+	Priority uint32
 }
 
 //NodeEphemera is local data kept about this node, it is used to query
@@ -28,11 +37,14 @@ type NodeEphemera struct {
 	LastConnection    uint64 //Last time we successfully connected to this node
 	LastConnReceived  uint64 //Last time this node connected to us
 	NextAttempt       uint64 //The next time we should attempt to connect to this node
+	ConnFailures      uint32 //Failed attempts to connect since we last connected
 	ConnectionPending bool
-	Connected         bool //Are we currently connected
+	Connected         bool   //Are we currently connected
+	LastAddress       string //The address we last reached this node on
 }
 
-//Digest Node
+//Digest Node.  Seq and Addresses are only hashed when they are
+//set, so a Node signed before they existed still verifies.
 func (a *Node) Digest() []byte {
 	h := sha512.New()
 	gripcrypto.HashBool(h, a.Connectable)
@@ -41,6 +53,13 @@ func (a *Node) Digest() []byte {
 	gripcrypto.HashString(h, a.Name)
 	gripcrypto.HashBytes(h, a.PublicKey)
 	gripcrypto.HashString(h, a.URL)
+	if a.Seq != 0 {
+		gripcrypto.HashUint64(h, a.Seq)
+	}
+	for _, v := range a.Addresses {
+		gripcrypto.HashString(h, v.URL)
+		gripcrypto.HashUint32(h, v.Priority)
+	}
 	a.Dig = h.Sum(nil)
 	return a.Dig
 }
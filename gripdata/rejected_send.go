@@ -7,4 +7,7 @@ type RejectedSendData struct {
 	Dig       []byte //The digest of the data to send
 	Timestamp uint64 //The time this was created
 	Message   string
+	Code      int    //griperrors code for why, zero if the node sent none
+	TypeName  string //The struct type
+	Retries   uint32 //How many times it was sent again
 }
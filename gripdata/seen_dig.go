@@ -0,0 +1,8 @@
+package gripdata
+
+//SeenDig a node is known to have a record
+type SeenDig struct {
+	Dig       []byte //The digest of the record
+	NodeID    []byte //The node that has it
+	Timestamp uint64 //When we learned it
+}
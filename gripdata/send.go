@@ -7,4 +7,5 @@ type SendData struct {
 	Dig       []byte //The digest of the data to send
 	Timestamp uint64 //The time this was created
 	TypeName  string //The struct type
+	Retries   uint32 //How many times it was rejected and sent again
 }
@@ -1,5 +1,10 @@
 package griperrors
 
+import (
+	"fmt"
+	"sort"
+)
+
 const (
 	//EnUs US English
 	EnUs = "en-us"
@@ -8,30 +13,181 @@ const (
 	DEF  = EnUs
 )
 
-var ShareNodeKeyEmpty error = GErr(2).Msg(EnUs, "Key cannot be empty")
-var WrongType error = GErr(3).Msg(EnUs, "Wrong type")
-var TargetNodeNil error = GErr(5).Msg(EnUs, "Target node id cannot be nil")
-var AccountNotEnabled error = GErr(6).Msg(EnUs, "Node account is not enabled")
-var NodeAccountKeyNotFound error = GErr(7).Msg(EnUs, "Node account key not found")
-var NodeAccountKeyUsed error = GErr(8).Msg(EnUs, "Onetime node account key has been used")
-var NodeAccountKeyExpired error = GErr(9).Msg(EnUs, "Node account key has expired")
-var AccountNotFound error = GErr(10).Msg(EnUs, "Account could not be found")
-var AccountKeyNotAllowed error = GErr(11).Msg(EnUs, "Account does not allow node account keys")
-var MaxNodesForAccount error = GErr(12).Msg(EnUs, "Maximum number of nodes for account reached")
-var NotContextSource error = GErr(13).Msg(EnUs, "You don't have permission to add files to context")
-var DependencyProblems error = GErr(14).Msg(EnUs, "Context file dependency problems found")
-var InvalidFileSize error = GErr(15).Msg(EnUs, "ContextFile had invalid file size")
+var ShareNodeKeyEmpty error = GErr(2).Msg(EnUs, "Key cannot be empty").
+	Msg(EsMx, "La clave no puede estar vacía")
+var WrongType error = GErr(3).Msg(EnUs, "Wrong type").
+	Msg(EsMx, "Tipo incorrecto")
+var TargetNodeNil error = GErr(5).Msg(EnUs, "Target node id cannot be nil").
+	Msg(EsMx, "El id del nodo destino no puede ser nulo")
+var AccountNotEnabled error = GErr(6).Msg(EnUs, "Node account is not enabled").
+	Msg(EsMx, "La cuenta del nodo no está habilitada")
+var NodeAccountKeyNotFound error = GErr(7).Msg(EnUs, "Node account key not found").
+	Msg(EsMx, "No se encontró la clave de cuenta del nodo")
+var NodeAccountKeyUsed error = GErr(8).Msg(EnUs, "Onetime node account key has been used").
+	Msg(EsMx, "La clave de cuenta del nodo de un solo uso ya fue usada")
+var NodeAccountKeyExpired error = GErr(9).Msg(EnUs, "Node account key has expired").
+	Msg(EsMx, "La clave de cuenta del nodo ha expirado")
+var AccountNotFound error = GErr(10).Msg(EnUs, "Account could not be found").
+	Msg(EsMx, "No se pudo encontrar la cuenta")
+var AccountKeyNotAllowed error = GErr(11).Msg(EnUs, "Account does not allow node account keys").
+	Msg(EsMx, "La cuenta no permite claves de cuenta de nodo")
+var MaxNodesForAccount error = GErr(12).Msg(EnUs, "Maximum number of nodes for account reached").
+	Msg(EsMx, "Se alcanzó el número máximo de nodos para la cuenta")
+var NotContextSource error = GErr(13).Msg(EnUs, "You don't have permission to add files to context").
+	Msg(EsMx, "No tienes permiso para agregar archivos al contexto")
+var DependencyProblems error = GErr(14).Msg(EnUs, "Context file dependency problems found").
+	Msg(EsMx, "Se encontraron problemas de dependencias en el archivo del contexto")
+var InvalidFileSize error = GErr(15).Msg(EnUs, "ContextFile had invalid file size").
+	Msg(EsMx, "El archivo del contexto tiene un tamaño inválido")
+var UnknownMessageType error = GErr(16).Msg(EnUs, "Unknown message type").
+	Msg(EsMx, "Tipo de mensaje desconocido")
+var FrameTooLarge error = GErr(17).Msg(EnUs, "Frame too large").
+	Msg(EsMx, "Trama demasiado grande")
+var UnsupportedWireVersion error = GErr(18).Msg(EnUs, "Unsupported wire protocol version").
+	Msg(EsMx, "Versión del protocolo de red no soportada")
+var MalformedMessage error = GErr(19).Msg(EnUs, "Malformed message").
+	Msg(EsMx, "Mensaje mal formado")
+var UnsupportedFieldType error = GErr(20).Msg(EnUs, "Message field type cannot be encoded").
+	Msg(EsMx, "El tipo de campo del mensaje no se puede codificar")
+var IncompatibleVersion error = GErr(21).Msg(EnUs, "No protocol version in common with node").
+	Msg(EsMx, "No hay una versión del protocolo en común con el nodo")
+var NoIntroduction error = GErr(22).Msg(EnUs, "Node did not introduce itself").
+	Msg(EsMx, "El nodo no se presentó")
+var FileDataMismatch error = GErr(23).Msg(EnUs, "File data does not match ContextFile").
+	Msg(EsMx, "Los datos del archivo no coinciden con el archivo del contexto")
+var SendQueueFull error = GErr(24).Msg(EnUs, "Send queue is full").
+	Msg(EsMx, "La cola de envío está llena")
+var ConnectionClosed error = GErr(25).Msg(EnUs, "Connection closed").
+	Msg(EsMx, "Conexión cerrada")
+var ShutdownTimeout error = GErr(26).Msg(EnUs, "Routines still running after shutdown timeout").
+	Msg(EsMx, "Las rutinas siguen corriendo después del tiempo límite de cierre")
+var RelayNotEnabled error = GErr(27).Msg(EnUs, "Node does not relay connections").
+	Msg(EsMx, "El nodo no retransmite conexiones")
+var RelayNotShared error = GErr(28).Msg(EnUs, "Both nodes must share with the relay").
+	Msg(EsMx, "Ambos nodos deben compartir con el retransmisor")
+var RelayTargetNotConnected error = GErr(29).Msg(EnUs, "Relay is not connected to the target node").
+	Msg(EsMx, "El retransmisor no está conectado al nodo destino")
+var RelayLimit error = GErr(30).Msg(EnUs, "Relay limit reached").
+	Msg(EsMx, "Se alcanzó el límite de retransmisión")
+var MailInvalid error = GErr(31).Msg(EnUs, "Mail does not match its digest").
+	Msg(EsMx, "El correo no coincide con su resumen")
+var MailNoAccount error = GErr(32).Msg(EnUs, "No account for the node the mail is for").
+	Msg(EsMx, "No hay cuenta para el nodo al que va el correo")
+var DiscoveryInvalid error = GErr(33).Msg(EnUs, "Discovery announcement is invalid").
+	Msg(EsMx, "El anuncio de descubrimiento es inválido")
+var DiscoveryStale error = GErr(34).Msg(EnUs, "Discovery announcement is too old").
+	Msg(EsMx, "El anuncio de descubrimiento es demasiado viejo")
+var NodeOutdated error = GErr(35).Msg(EnUs, "Node record is not newer than the one we have").
+	Msg(EsMx, "El registro del nodo no es más nuevo que el que tenemos")
+var NodeNotFound error = GErr(36).Msg(EnUs, "Node was not found in db").
+	Msg(EsMx, "No se encontró el nodo en la base de datos").Transient()
+var ContextNotFound error = GErr(37).Msg(EnUs, "Context was not found").
+	Msg(EsMx, "No se encontró el contexto").Transient()
+var ContextPairNotFound error = GErr(38).Msg(EnUs, "Missing request/response from source node").
+	Msg(EsMx, "Falta la solicitud o la respuesta del nodo origen").Transient()
+var ContextFileParentNotFound error = GErr(39).Msg(EnUs, "Context file depends on a file that was not found").
+	Msg(EsMx, "El archivo del contexto depende de un archivo que no se encontró").Transient()
+var NodeIDNotSet error = GErr(40).Msg(EnUs, "NodeID was not set").
+	Msg(EsMx, "No se estableció el NodeID")
+var InvalidSignature error = GErr(41).Msg(EnUs, "Signature was not valid").
+	Msg(EsMx, "La firma no es válida")
+var NodeKeyMissing error = GErr(42).Msg(EnUs, "Public key and ID must be specified").
+	Msg(EsMx, "Se deben especificar la llave pública y el ID")
+var NodeIDMismatch error = GErr(43).Msg(EnUs, "ID does not match public key").
+	Msg(EsMx, "El ID no coincide con la llave pública")
+var ContextRequestExists error = GErr(44).Msg(EnUs, "There is already a ContextRequest for this node").
+	Msg(EsMx, "Ya existe una solicitud de contexto para este nodo")
+var NotContextNode error = GErr(45).Msg(EnUs, "Source node does not have permission add nodes").
+	Msg(EsMx, "El nodo origen no tiene permiso para agregar nodos")
+var PermissionEscalation error = GErr(46).Msg(EnUs, "Cannot escalate permissions").
+	Msg(EsMx, "No se pueden escalar los permisos")
+var MaxContextsForAccount error = GErr(47).Msg(EnUs, "Too many contexts for account").
+	Msg(EsMx, "Demasiados contextos para la cuenta")
+var CreateSendFailed error = GErr(48).Msg(EnUs, "Failed to create send request").
+	Msg(EsMx, "No se pudo crear la solicitud de envío")
+var ContextRequestNotFound error = GErr(49).Msg(EnUs, "You have to have a request first").
+	Msg(EsMx, "Primero debes tener una solicitud")
+var TargetNodeNotFound error = GErr(50).Msg(EnUs, "Unknown target node").
+	Msg(EsMx, "Nodo destino desconocido")
+var PathNotFound error = GErr(51).Msg(EnUs, "Path does not exist").
+	Msg(EsMx, "La ruta no existe")
+var PathNotRegularFile error = GErr(52).Msg(EnUs, "Path is not a regular file").
+	Msg(EsMx, "La ruta no es un archivo regular")
+var ContextFileExists error = GErr(53).Msg(EnUs, "We already have this file").
+	Msg(EsMx, "Ya tenemos este archivo")
+var ReciprocateFailed error = GErr(54).Msg(EnUs, "Failed to reciprocate context data").
+	Msg(EsMx, "No se pudieron intercambiar los datos del contexto")
+var MailWrongTarget error = GErr(55).Msg(EnUs, "Mail is for a different node").
+	Msg(EsMx, "El correo es para otro nodo")
+var MailNotAllowed error = GErr(56).Msg(EnUs, "Node may not leave mail for this node").
+	Msg(EsMx, "El nodo no puede dejar correo para este nodo")
+
+//codes every Griperr by its code
+var codes = make(map[int]*Griperr)
 
+//GErr panics if code is already used, a second error with the
+//same code would be rendered with the first one's message
 func GErr(code int) *Griperr {
+	if codes[code] != nil {
+		panic(fmt.Sprintf("griperrors: code %d registered twice", code))
+	}
 	var g Griperr
 	g.Code = code
 	g.Message = make(map[string]string)
+	codes[code] = &g
 	return &g
 }
 
 type Griperr struct {
 	Code    int
 	Message map[string]string
+	Retry   bool //The data may be accepted if it is sent again later
+}
+
+//Transient the error goes away once the node has the data
+//it is missing
+func (e *Griperr) Transient() *Griperr {
+	e.Retry = true
+	return e
+}
+
+//Code the code of err, zero if it is not a Griperr
+func Code(err error) int {
+	if g, ok := err.(*Griperr); ok {
+		return g.Code
+	}
+	return 0
+}
+
+//IsTransient true if code is for a Transient error
+func IsTransient(code int) bool {
+	g := codes[code]
+	return g != nil && g.Retry
+}
+
+//ByCode the Griperr with code, nil if there is none
+func ByCode(code int) *Griperr {
+	return codes[code]
+}
+
+//Codes every code in use
+func Codes() []int {
+	var cl []int
+	for c := range codes {
+		cl = append(cl, c)
+	}
+	sort.Ints(cl)
+	return cl
+}
+
+//Render the message for code in language l.  It falls back to
+//DEF, then to msg if the code is not known.
+func Render(code int, l string, msg string) string {
+	g := codes[code]
+	if g == nil {
+		return msg
+	}
+	return g.In(l)
 }
 
 func (e *Griperr) Msg(l string, m string) *Griperr {
@@ -42,3 +198,11 @@ func (e *Griperr) Msg(l string, m string) *Griperr {
 func (e *Griperr) Error() string {
 	return e.Message[DEF]
 }
+
+//In the message in language l, or DEF if there is no translation
+func (e *Griperr) In(l string) string {
+	if m, ok := e.Message[l]; ok {
+		return m
+	}
+	return e.Message[DEF]
+}
@@ -0,0 +1,44 @@
+package griptests
+
+import (
+	"testing"
+
+	"github.com/wyathan/grip"
+)
+
+func TestBatchedDigests(t *testing.T) {
+	const num = 300
+	caps := grip.Capabilities
+	defer func() {
+		grip.Capabilities = caps
+	}()
+
+	_, tn := sendRecordsOver(t, num)
+	if tn.Messages("CheckDig") != 0 || tn.Messages("RespDig") != 0 {
+		t.Errorf("Digests checked one at a time: %d", tn.Messages("CheckDig"))
+	}
+	if tn.Messages("CheckDigs") == 0 || tn.Messages("CheckDigs") >= num/10 {
+		t.Errorf("Unexpected CheckDigs: %d", tn.Messages("CheckDigs"))
+	}
+	if tn.Messages("AckDigs") == 0 || tn.Messages("AckDig") >= num/10 {
+		t.Errorf("Records not acknowledged together: %d AckDigs %d AckDig",
+			tn.Messages("AckDigs"), tn.Messages("AckDig"))
+	}
+
+	//A node without the capability still gets everything
+	var single []string
+	for _, c := range caps {
+		if c != grip.CAPBATCHDIGS {
+			single = append(single, c)
+		}
+	}
+	grip.Capabilities = single
+	_, tn = sendRecordsOver(t, num)
+	if tn.Messages("CheckDigs") != 0 || tn.Messages("AckDigs") != 0 {
+		t.Error("Batched digests used without the capability")
+	}
+	if tn.Messages("CheckDig") < num || tn.Messages("AckDig") < num {
+		t.Errorf("Expected a CheckDig and AckDig for each record: %d %d",
+			tn.Messages("CheckDig"), tn.Messages("AckDig"))
+	}
+}
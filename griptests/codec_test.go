@@ -0,0 +1,92 @@
+package griptests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	var n gripdata.Node
+	var pn gripdata.MyNodePrivateData
+	n.Name = "codec"
+	n.URL = "tcp://127.0.0.1:1"
+	n.Addresses = []gripdata.NodeAddress{{URL: "tcp://[::1]:1", Priority: 1}}
+	n.Connectable = true
+	grip.CreateNewNode(&pn, &n, NewTestDB())
+	var cf gripdata.ContextFile
+	cf.Index = true
+	cf.DependsOn = [][]byte{[]byte("one"), []byte("two")}
+	cf.NodeID = n.ID
+	cf.CreatedOn = 1 << 40
+	cf.Size = 12345
+	var rq gripdata.ContextRequest
+	rq.CacheMode = 7
+	rq.FullRepo = true
+	msgs := []interface{}{
+		&n, &cf, &rq,
+		grip.CheckDig{Dig: n.Dig},
+		grip.RejectDig{Dig: n.Dig, Message: "no", Code: 37},
+		grip.HandshakeHello{Node: &n, Nonce: []byte{1, 2, 3}},
+	}
+	for _, m := range msgs {
+		b, err := grip.EncodeMessage(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := grip.DecodeMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, d) {
+			t.Errorf("%s did not survive the codec", grip.WireTypeName(m))
+		}
+	}
+}
+
+func TestCodecRejects(t *testing.T) {
+	b, err := grip.EncodeMessage(grip.AckDig{Dig: []byte("digest")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = grip.EncodeMessage(struct{ A int }{})
+	if err != griperrors.UnknownMessageType {
+		t.Error("Encoded an unregistered type")
+	}
+	bad := append([]byte(nil), b...)
+	binary.BigEndian.PutUint16(bad[1:], 9999)
+	if _, err = grip.DecodeMessage(bad); err != griperrors.UnknownMessageType {
+		t.Errorf("Unknown tag: %v", err)
+	}
+	bad = append([]byte(nil), b...)
+	bad[0] = grip.WIREVERSION + 1
+	if _, err = grip.DecodeMessage(bad); err != griperrors.UnsupportedWireVersion {
+		t.Errorf("Bad version: %v", err)
+	}
+	if _, err = grip.DecodeMessage(b[:len(b)-1]); err != griperrors.MalformedMessage {
+		t.Errorf("Truncated: %v", err)
+	}
+	if _, err = grip.DecodeMessage(append(b, 0)); err != griperrors.MalformedMessage {
+		t.Errorf("Trailing bytes: %v", err)
+	}
+
+	var f bytes.Buffer
+	err = grip.WriteFrame(&f, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := grip.ReadFrame(&f)
+	if err != nil || !bytes.Equal(r, b) {
+		t.Error("Frame did not round trip")
+	}
+	var h [grip.FRAMEHEADERSIZE]byte
+	binary.BigEndian.PutUint32(h[:], uint32(grip.MAXFRAMESIZE+1))
+	if _, err = grip.ReadFrame(bytes.NewReader(h[:])); err != griperrors.FrameTooLarge {
+		t.Errorf("Oversized frame: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package griptests
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+func TestCompressedMessages(t *testing.T) {
+	var n gripdata.Node
+	var pn gripdata.MyNodePrivateData
+	n.Name = "compress"
+	grip.CreateNewNode(&pn, &n, NewTestDB())
+	text := bytes.Repeat([]byte("the same words over and over "), 2000)
+	ml := []interface{}{&n, grip.CheckDig{Dig: n.Dig}, grip.FileChunk{Dig: n.Dig, Data: text, Last: true}}
+	c, err := grip.DeflateMessages(ml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Data) >= len(text)/4 {
+		t.Errorf("Compressed to %d bytes from more than %d", len(c.Data), len(text))
+	}
+	dl, err := grip.InflateMessages(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ml, dl) {
+		t.Error("Messages did not survive compression")
+	}
+
+	nc, _ := grip.DeflateMessages([]interface{}{c})
+	if _, err = grip.InflateMessages(nc); err == nil {
+		t.Error("Inflated a Compressed inside a Compressed")
+	}
+	if _, err = grip.InflateMessages(grip.Compressed{Data: []byte("not deflate")}); err == nil {
+		t.Error("Inflated garbage")
+	}
+
+	noise := make([]byte, grip.FILECHUNKSIZE)
+	rand.Read(noise)
+	if grip.Compressible(noise) {
+		t.Error("Random data is compressible")
+	}
+	if !grip.Compressible(text) {
+		t.Error("Text is not compressible")
+	}
+}
+
+//sendRecordsOver sends num ShareNodeInfo records from node 1 to
+//node 0 and returns the bytes that crossed the test network for
+//them, and the network
+func sendRecordsOver(tb testing.TB, num int) (uint64, *TestNetwork) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		s := grip.NewSocketController(tn.Open(n.ID, c), db)
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		tb.Fatal("Failed to send associate node keys")
+	}
+	before := tn.WireBytes()
+	for c := 0; c < num; c++ {
+		var shr gripdata.ShareNodeInfo
+		shr.Key = fmt.Sprintf("share key %d", c)
+		shr.TargetNodeID = nodes[0].ID
+		err := grip.NewShareNode(&shr, dbs[1])
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		tb.Fatal("Failed to send the records")
+	}
+	return tn.WireBytes() - before, tn
+}
+
+//BenchmarkRecordCompression reports the bytes each record takes
+//on the test network with and without compression
+func BenchmarkRecordCompression(b *testing.B) {
+	const num = 200
+	caps := grip.Capabilities
+	defer func() {
+		grip.Capabilities = caps
+	}()
+	var plain []string
+	for _, c := range caps {
+		if c != grip.CAPDEFLATE {
+			plain = append(plain, c)
+		}
+	}
+	for _, bc := range []struct {
+		name string
+		caps []string
+	}{{"plain", plain}, {"deflate", caps}} {
+		b.Run(bc.name, func(b *testing.B) {
+			grip.Capabilities = bc.caps
+			var wire uint64
+			for i := 0; i < b.N; i++ {
+				w, _ := sendRecordsOver(b, num)
+				wire += w
+			}
+			b.ReportMetric(float64(wire)/float64(b.N*num), "wirebytes/record")
+		})
+	}
+}
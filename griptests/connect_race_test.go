@@ -0,0 +1,79 @@
+package griptests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+func getConnection(s *grip.SocketController, id []byte) *grip.ConnectionController {
+	s.Lock()
+	defer s.Unlock()
+	return s.Connections[base64.StdEncoding.EncodeToString(id)]
+}
+
+//TestSimultaneousConnect checks two nodes that dial each other at
+//the same time both keep the connection dialed by the lower ID
+func TestSimultaneousConnect(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	tn.DialGate = make(chan bool)
+	defer func() {
+		for _, s := range SOCKETS {
+			s.Close()
+		}
+	}()
+	var nodes []*gripdata.Node
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		_, n, db := createNewNode(c, true, tn)
+		nodes = append(nodes, n)
+		dbs = append(dbs, db)
+	}
+	for c := 0; c < 2; c++ {
+		o := nodes[1-c]
+		dbs[c].StoreNode(o)
+		dbs[c].CreateNodeEphemera(o.ID, true)
+	}
+	dialing := func() bool {
+		return tn.Dialing() == 2
+	}
+	if !WaitFor(dialing, 10*time.Second) {
+		t.Fatal("Nodes did not dial each other")
+	}
+	close(tn.DialGate)
+
+	lower := 0
+	if bytes.Compare(nodes[1].ID, nodes[0].ID) < 0 {
+		lower = 1
+	}
+	settled := func() bool {
+		for c := 0; c < 2; c++ {
+			cc := getConnection(SOCKETS[c], nodes[1-c].ID)
+			if cc == nil || cc.IsDone() || cc.Incoming != (c != lower) {
+				return false
+			}
+		}
+		return true
+	}
+	if !WaitFor(settled, 10*time.Second) {
+		t.Fatal("Nodes did not keep the connection dialed by the lower ID")
+	}
+	a := getConnection(SOCKETS[0], nodes[1].ID)
+	b := getConnection(SOCKETS[1], nodes[0].ID)
+	time.Sleep(2 * grip.CONNECTROUTINESLEEP)
+	if a != getConnection(SOCKETS[0], nodes[1].ID) || b != getConnection(SOCKETS[1], nodes[0].ID) {
+		t.Error("Nodes are still changing connections")
+	}
+	for c := 0; c < 2; c++ {
+		ep := dbs[c].GetNodeEphemera(nodes[1-c].ID)
+		if ep == nil || !ep.Connected {
+			t.Errorf("Node %d Ephemera does not say connected", c)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package griptests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+func TestContextSummary(t *testing.T) {
+	var a, b [][]byte
+	for c := 0; c < 1000; c++ {
+		d := []byte{byte(c), byte(c >> 8), 1}
+		a = append(a, d)
+		if c != 7 {
+			b = append(b, d)
+		}
+	}
+	b = append(b, []byte{9, 0, 2})
+	sa := grip.NewContextSummary(a)
+	sb := grip.NewContextSummary(b)
+	if !bytes.Equal(sa.Root(), grip.NewContextSummary(a).Root()) {
+		t.Error("Root depends on more than the digests")
+	}
+	if bytes.Equal(sa.Root(), sb.Root()) {
+		t.Error("Different digests have the same root")
+	}
+	d := sa.Diff(sb.Hashes())
+	if !bytes.Equal(d, []byte{7, 9}) {
+		t.Errorf("Expected buckets 7 and 9 to differ: %v", d)
+	}
+	if len(sa.Digs(d)) != 8 || len(sb.Digs(d)) != 8 {
+		t.Errorf("Unexpected digests in the buckets: %d %d", len(sa.Digs(d)), len(sb.Digs(d)))
+	}
+
+	//1000 digests are 3 or 4 to a bucket
+	all := make([]byte, grip.SYNCBUCKETS)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	gl := sa.Split(all, 10)
+	n := 0
+	for _, g := range gl {
+		if len(sa.Digs(g)) > 10 {
+			t.Errorf("Group has %d digests", len(sa.Digs(g)))
+		}
+		n += len(g)
+	}
+	if n != grip.SYNCBUCKETS || len(gl) < 1000/10 {
+		t.Errorf("Unexpected groups: %d buckets in %d", n, len(gl))
+	}
+	if gl = sa.Split([]byte{1, 2}, 2); len(gl) != 2 || len(sa.Digs(gl[0])) != 4 {
+		t.Error("A bucket larger than the limit is not on its own")
+	}
+}
+
+//TestContextSync node 1 has a ContextFile that was never sent, and
+//loses the ContextResponse from node 0.  Comparing the context
+//fills both gaps.
+func TestContextSync(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		s := grip.NewSocketController(tn.Open(n.ID, c), db)
+		s.SyncInterval = 500 * time.Millisecond
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send associate node keys")
+	}
+
+	var ctx gripdata.Context
+	ctx.Name = "synccontext"
+	err := grip.NewContext(&ctx, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	//No one else is in the context yet, so it is not sent
+	var f gripdata.ContextFile
+	f.Context = ctx.Dig
+	f.Snapshot = true
+	f.SetPath(MakeTempFile())
+	err = grip.NewContextFile(&f, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rq gripdata.ContextRequest
+	rq.ContextDig = ctx.Dig
+	rq.TargetNodeID = nodes[0].ID
+	err = grip.NewContextRequest(&rq, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, time.Minute) {
+		t.Fatal("Node 0 did not respond")
+	}
+
+	dbs[1].Lock()
+	rsp := dbs[1].ContextResponses[base64.StdEncoding.EncodeToString(ctx.Dig)]
+	delete(dbs[1].DigData, base64.StdEncoding.EncodeToString(rsp[base64.StdEncoding.EncodeToString(nodes[0].ID)].Dig))
+	delete(rsp, base64.StdEncoding.EncodeToString(nodes[0].ID))
+	dbs[1].Unlock()
+
+	if !WaitFor(func() bool {
+		return len(dbs[0].GetContextFiles(ctx.Dig)) == 1
+	}, time.Minute) {
+		t.Error("ContextFile never reached node 0")
+	}
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, time.Minute) {
+		t.Error("Lost ContextResponse was not sent again")
+	}
+
+	//A new connection compares contexts without waiting the
+	//default SyncInterval
+	SOCKETS[1].Close()
+	roots := tn.Messages("SyncRoot")
+	s := grip.NewSocketController(tn.Open(nodes[1].ID, 1), dbs[1])
+	s.Start(context.Background())
+	SOCKETS = append(SOCKETS, s)
+	if !WaitFor(func() bool {
+		return tn.Messages("SyncRoot") > roots
+	}, time.Minute) {
+		t.Error("No SyncRoot sent on a new connection")
+	}
+}
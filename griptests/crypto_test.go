@@ -3,6 +3,7 @@ package griptests
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
@@ -48,6 +49,66 @@ func TestNodeGeneratedAccountSig(t *testing.T) {
 
 }
 
+//malformedKeys returns every truncation of b, plus copies of b
+//with each big int length field set far past the end
+func malformedKeys(b []byte) [][]byte {
+	var r [][]byte
+	for c := 0; c < len(b); c++ {
+		r = append(r, b[:c])
+	}
+	idx := gripcrypto.MODELEN
+	for idx+8 <= len(b) {
+		o := make([]byte, len(b))
+		copy(o, b)
+		binary.BigEndian.PutUint64(o[idx:], 1<<40)
+		r = append(r, o)
+		o = make([]byte, len(b))
+		copy(o, b)
+		binary.BigEndian.PutUint64(o[idx:], ^uint64(0))
+		r = append(r, o)
+		idx += 8 + int(binary.BigEndian.Uint64(b[idx:]))
+	}
+	return r
+}
+
+//TestVerifyMalformed checks truncated and oversized keys and
+//signatures fail to verify instead of panicking
+func TestVerifyMalformed(t *testing.T) {
+	prv, pub, err := gripcrypto.GenerateECDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n gripdata.NodeGeneratedAccount
+	n.AccountID = "AAAAAAAAA00000"
+	n.NodeID = make([]byte, 10)
+	rand.Read(n.NodeID)
+	err = gripcrypto.Sign(&n, prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := n.Sig
+	for _, k := range malformedKeys(pub) {
+		if gripcrypto.Verify(&n, k) {
+			t.Errorf("Malformed key verified: %x", k)
+		}
+	}
+	for _, s := range malformedKeys(sig) {
+		n.Sig = s
+		if gripcrypto.Verify(&n, pub) {
+			t.Errorf("Malformed signature verified: %x", s)
+		}
+	}
+	for _, k := range malformedKeys(prv) {
+		if gripcrypto.Sign(&n, k) == nil {
+			t.Errorf("Signed with malformed key: %x", k)
+		}
+	}
+	n.Sig = sig
+	if !gripcrypto.Verify(&n, pub) {
+		t.Error("Failed to verify sig")
+	}
+}
+
 func TestNodeGeneratedAccountDigest(t *testing.T) {
 	var n, m gripdata.NodeGeneratedAccount
 	n.AccountID = "AAAAAAAAA00000"
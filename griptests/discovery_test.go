@@ -0,0 +1,108 @@
+package griptests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//TestDiscovery checks a node that hears another's announcement
+//stores it and uses the discovery key with it
+func TestDiscovery(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer func() {
+		for _, s := range SOCKETS {
+			s.Close()
+		}
+	}()
+	pn0, n0, db0 := createNewNode(0, true, tn)
+	pn1, n1, db1 := createNewNode(1, true, tn)
+	_, _, db2 := createNewNode(2, true, tn)
+	for _, pn := range []*gripdata.MyNodePrivateData{pn0, pn1} {
+		pn.AutoCreateShareAccount = true
+		pn.AutoAccountMaxDiskSpace = 4096
+	}
+
+	d := grip.NewDiscovery("lan")
+	b, err := d.Announce(db0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, err := d.Announce(db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.Incoming(b, db0)
+	if err != nil || n != nil {
+		t.Error("Our own announcement not ignored")
+	}
+	n, err = grip.NewDiscovery("other").Incoming(b, db2)
+	if err != nil || n != nil || db2.GetNode(n0.ID) != nil {
+		t.Error("Announcement for another key not ignored")
+	}
+
+	a := d.NewAnnouncement(n0, uint64(time.Now().UnixNano()))
+	a.Timestamp++
+	tb, _ := grip.EncodeMessage(a)
+	if _, err = d.Incoming(tb, db2); err != griperrors.DiscoveryInvalid {
+		t.Errorf("Tampered announcement not rejected: %v", err)
+	}
+	old := uint64(time.Now().Add(-2 * grip.DISCOVERYMAXAGE).UnixNano())
+	ob, _ := grip.EncodeMessage(d.NewAnnouncement(n0, old))
+	if _, err = d.Incoming(ob, db2); err != griperrors.DiscoveryStale {
+		t.Errorf("Stale announcement not rejected: %v", err)
+	}
+	if db2.GetNode(n0.ID) != nil {
+		t.Error("Rejected announcement stored the node")
+	}
+
+	_, err = d.Incoming(b1, db0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = d.Incoming(b, db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == nil || db1.GetNode(n0.ID) == nil || db1.GetNodeEphemera(n0.ID) == nil {
+		t.Fatal("Announced node not stored")
+	}
+	_, err = d.Incoming(b, db1)
+	if err != nil {
+		t.Error(err)
+	}
+	used := 0
+	for _, u := range db1.ListUseShareNodeKey(d.Key) {
+		if bytes.Equal(u.NodeID, n1.ID) {
+			used++
+		}
+	}
+	if used != 1 {
+		t.Error("Discovery key used more than once")
+	}
+	if db0.GetNodeAccount(n1.ID) == nil {
+		t.Error("Account not created for the discovered node")
+	}
+	exchanged := func() bool {
+		return len(db0.ListUseShareNodeKey(d.Key)) == 2 && len(db1.ListUseShareNodeKey(d.Key)) == 2
+	}
+	if !WaitFor(exchanged, time.Minute) {
+		t.Error("Discovered node did not use the key")
+	}
+	if len(db1.ListShareNodeInfo(n1.ID)) != 1 {
+		t.Error("ShareNodeInfo for the key not created once")
+	}
+	shared := func() bool {
+		return len(db0.ListShareNodeKey(d.Key)) == 2 && len(db1.ListShareNodeKey(d.Key)) == 2 &&
+			db0.GetNode(n1.ID) != nil && db1.GetNode(n0.ID) != nil
+	}
+	if !WaitFor(shared, time.Minute) {
+		t.Error("Discovered nodes did not share with each other")
+	}
+}
@@ -0,0 +1,163 @@
+package griptests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//TestFileStreamResume sends file data over the test network when
+//the receiving node already has the first half of it
+func TestFileStreamResume(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	defer tn.CloseAll()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		pr, n, db := createNewNode(c, c == 0, tn)
+		nodes = append(nodes, n)
+		pnodes = append(pnodes, pr)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, 2*time.Minute) {
+		t.Fatal("Failed to send associate node keys")
+	}
+	a := *dbs[0].GetAccount("node1")
+	a.MaxDiskSpace = 16 * 1024 * 1024
+	dbs[0].StoreAccount(&a)
+
+	var ctx gripdata.Context
+	ctx.Name = "filestream"
+	err := grip.NewContext(&ctx, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rq gripdata.ContextRequest
+	rq.ContextDig = ctx.Dig
+	rq.TargetNodeID = nodes[0].ID
+	err = grip.NewContextRequest(&rq, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitUntilSentWithin(nodes, dbs, 2*time.Minute) {
+		t.Fatal("Failed to send context request")
+	}
+
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	tf, err := ioutil.TempFile("", "grip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.Write(data)
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	//Work out the digest first so half the data can be
+	//left where an earlier connection would have put it
+	var f gripdata.ContextFile
+	f.Context = ctx.Dig
+	f.Snapshot = true
+	f.NodeID = nodes[1].ID
+	f.Size = uint64(len(data))
+	f.SetPath(tf.Name())
+	f.Digest()
+	dp := grip.ContextFileDataPath(pnodes[0], &f)
+	os.MkdirAll(grip.NodeDataDir(pnodes[0]), 0700)
+	half := len(data) / 2
+	err = ioutil.WriteFile(dp+grip.PARTSUFFIX, data[:half], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dp)
+
+	err = grip.NewContextFile(&f, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := func() bool {
+		return dbs[0].GetDigestData(f.Dig) != nil
+	}
+	if !WaitFor(got, 2*time.Minute) {
+		t.Fatal("Node 0 did not get the file")
+	}
+	rd, err := ioutil.ReadFile(dp)
+	if err != nil || !bytes.Equal(rd, data) {
+		t.Error("File data was not copied")
+	}
+	slack := uint64(grip.FILECHUNKWINDOW) * uint64(grip.FILECHUNKSIZE)
+	if tn.FileBytes() > uint64(len(data)-half)+slack {
+		t.Errorf("Sent %d bytes of file data, only %d were needed", tn.FileBytes(), len(data)-half)
+	}
+}
+
+func makeLaneFile(t *testing.T, size int) string {
+	f, err := ioutil.TempFile("", "grip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d := make([]byte, size)
+	rand.Read(d)
+	f.Write(d)
+	return f.Name()
+}
+
+//TestFileLanes checks file lanes take turns and only send
+//what the other node asked for
+func TestFileLanes(t *testing.T) {
+	cs := grip.FILECHUNKSIZE
+	asz := uint64(3*cs + 10)
+	bsz := uint64(cs / 2)
+	ap := makeLaneFile(t, int(asz))
+	defer os.Remove(ap)
+	bp := makeLaneFile(t, int(bsz))
+	defer os.Remove(bp)
+	ad := []byte("a")
+	bd := []byte("b")
+
+	var l grip.FileLanes
+	defer l.Close()
+	err := l.Grant(grip.FileChunkReq{Dig: ad, Offset: 0, Window: 2}, ap, asz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Grant(grip.FileChunkReq{Dig: bd, Offset: 0, Window: 4}, bp, bsz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		dig  []byte
+		off  uint64
+		last bool
+	}
+	check := func(w []want) {
+		for _, x := range w {
+			ch, err := l.Next()
+			if err != nil || ch == nil {
+				t.Fatalf("Expected a chunk at %d: %v", x.off, err)
+			}
+			if !bytes.Equal(ch.Dig, x.dig) || ch.Offset != x.off || ch.Last != x.last {
+				t.Errorf("Expected %s at %d last %t, got %s at %d last %t", x.dig, x.off, x.last, ch.Dig, ch.Offset, ch.Last)
+			}
+		}
+		if l.Active() {
+			t.Error("Lanes sent more than was asked for")
+		}
+	}
+	check([]want{{ad, 0, false}, {bd, 0, true}, {ad, uint64(cs), false}})
+	err = l.Grant(grip.FileChunkReq{Dig: ad, Offset: uint64(2 * cs), Window: 4}, ap, asz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check([]want{{ad, uint64(2 * cs), false}, {ad, uint64(3 * cs), true}})
+}
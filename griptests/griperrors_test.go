@@ -0,0 +1,41 @@
+package griptests
+
+import (
+	"testing"
+
+	"github.com/wyathan/grip/griperrors"
+)
+
+//TestErrorCatalog every code has a message in every language
+func TestErrorCatalog(t *testing.T) {
+	cl := griperrors.Codes()
+	if len(cl) == 0 {
+		t.Fatal("No codes")
+	}
+	for _, c := range cl {
+		g := griperrors.ByCode(c)
+		if g.Code != c {
+			t.Errorf("Code %d is registered as %d", g.Code, c)
+		}
+		for _, l := range []string{griperrors.EnUs, griperrors.EsMx} {
+			if g.Message[l] == "" {
+				t.Errorf("Code %d has no %s message", c, l)
+			}
+		}
+		if g.Message[griperrors.EnUs] == g.Message[griperrors.EsMx] {
+			t.Errorf("Code %d is not translated: %s", c, g.Message[griperrors.EsMx])
+		}
+	}
+	if griperrors.Render(griperrors.Code(griperrors.ContextNotFound), "fr-fr", "x") != griperrors.ContextNotFound.Error() {
+		t.Error("An unknown language should use the default")
+	}
+	if griperrors.Render(0, griperrors.EsMx, "peer message") != "peer message" {
+		t.Error("An unknown code should keep the message")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("A code was registered twice")
+		}
+	}()
+	griperrors.GErr(cl[0])
+}
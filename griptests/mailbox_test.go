@@ -0,0 +1,177 @@
+package griptests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//TestMailbox checks a record for an offline node is held by a
+//node with an Account for it, and collected when it comes back
+func TestMailbox(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer func() {
+		for _, s := range SOCKETS {
+			s.Close()
+		}
+	}()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 3; c++ {
+		pr, n, db := createNewNode(c, c == 0, tn)
+		nodes = append(nodes, n)
+		pnodes = append(pnodes, pr)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Associate node keys stuck")
+	}
+
+	//Take the recipient offline
+	SOCKETS[2].Close()
+	offline := func() bool {
+		ep := dbs[0].GetNodeEphemera(nodes[2].ID)
+		return ep != nil && !ep.Connected
+	}
+	if !WaitFor(offline, 10*time.Second) {
+		t.Fatal("Recipient still connected")
+	}
+	acct := dbs[0].GetAccount("node2")
+	used := acct.DiskSpaceUsed
+
+	dbs[1].StoreNode(nodes[2])
+	dbs[1].CreateNodeEphemera(nodes[2].ID, false)
+	err := grip.CreateNewSend(nodes[1], nodes[2].ID, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := func() bool {
+		return dbs[0].GetMail(nodes[2].ID, nodes[1].Dig) != nil
+	}
+	if !WaitFor(held, time.Minute) {
+		t.Fatal("Mailbox did not take the record")
+	}
+	m := dbs[0].GetMail(nodes[2].ID, nodes[1].Dig)
+	if dbs[0].GetAccount("node2").DiskSpaceUsed != used+m.Size {
+		t.Error("Mail not charged to the recipient's account")
+	}
+	if dbs[1].NumSendDataTo(nodes[2].ID) != 1 {
+		t.Error("Sender dropped its SendData before the record was delivered")
+	}
+	if !WaitFor(func() bool {
+		return dbs[1].GetMailDeposited(nodes[0].ID, nodes[2].ID, nodes[1].Dig) != nil
+	}, 10*time.Second) {
+		t.Error("Sender did not record which mailbox holds the record")
+	}
+
+	//Bring the recipient back
+	s := grip.NewSocketController(tn.Open(nodes[2].ID, 2), dbs[2])
+	s.Start(context.Background())
+	SOCKETS = append(SOCKETS, s)
+	delivered := func() bool {
+		return dbs[1].NumSendDataTo(nodes[2].ID) == 0
+	}
+	if !WaitFor(delivered, time.Minute) {
+		t.Fatal("Sender was not told the record was delivered")
+	}
+	if dbs[2].GetNode(nodes[1].ID) == nil {
+		t.Error("Recipient did not collect the record")
+	}
+	if dbs[0].GetMail(nodes[2].ID, nodes[1].Dig) != nil {
+		t.Error("Mailbox still holds the record")
+	}
+	if dbs[1].GetMailDeposited(nodes[0].ID, nodes[2].ID, nodes[1].Dig) != nil {
+		t.Error("Sender still has the deposit")
+	}
+	if u := dbs[0].GetAccount("node2").DiskSpaceUsed; u != used {
+		t.Errorf("Mail space not freed, %d used, expected %d", u, used)
+	}
+}
+
+//mailNode creates a node and gives it an Account with db if
+//acct is set
+func mailNode(acct string, db *TestDB) (*gripdata.Node, *TestDB) {
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	ndb := NewTestDB()
+	grip.CreateNewNode(&pr, &n, ndb)
+	if acct != "" {
+		var a gripdata.Account
+		a.AccountID = acct
+		a.Enabled = true
+		a.MaxDiskSpace = 1024 * 1024
+		db.StoreAccount(&a)
+		var na gripdata.NodeAccount
+		na.AccountID = acct
+		na.NodeID = n.ID
+		na.Enabled = true
+		db.StoreNodeAccount(&na)
+	}
+	return &n, ndb
+}
+
+func mailDeposit(r gripcrypto.SignInf, to []byte) *grip.MailDeposit {
+	b, _ := grip.EncodeMessage(r)
+	return &grip.MailDeposit{To: to, Dig: r.GetDig(), Data: b}
+}
+
+//TestStoreMail checks a mailbox only holds records signed by a
+//node it knows, for the node they are addressed to, left by a
+//node with an Account
+func TestStoreMail(t *testing.T) {
+	var mn gripdata.Node
+	var mpr gripdata.MyNodePrivateData
+	db := NewTestDB()
+	grip.CreateNewNode(&mpr, &mn, db)
+	to, _ := mailNode("to", db)
+	from, fdb := mailNode("from", db)
+	other, odb := mailNode("", db)
+	unknown, udb := mailNode("", db)
+	db.StoreNode(to)
+	db.StoreNode(from)
+	db.StoreNode(other)
+
+	key := func(k string, tid []byte, sdb *TestDB) *gripdata.AssociateNodeAccountKey {
+		var a gripdata.AssociateNodeAccountKey
+		a.Key = k
+		a.TargetNodeID = tid
+		grip.SignNodeSig(&a, sdb)
+		return &a
+	}
+	badsig := key("badsig", to.ID, fdb)
+	badsig.Sig[len(badsig.Sig)-1]++
+	tests := []struct {
+		name string
+		v    *grip.MailDeposit
+		from []byte
+		err  error
+	}{
+		{"valid", mailDeposit(key("valid", to.ID, fdb), to.ID), from.ID, nil},
+		{"node", mailDeposit(from, to.ID), from.ID, nil},
+		{"signed by other", mailDeposit(key("other", to.ID, odb), to.ID), from.ID, nil},
+		{"bad signature", mailDeposit(badsig, to.ID), from.ID, griperrors.InvalidSignature},
+		{"unknown signer", mailDeposit(key("unknown", to.ID, udb), to.ID), from.ID, griperrors.NodeNotFound},
+		{"unknown node", mailDeposit(unknown, to.ID), from.ID, nil},
+		{"wrong target", mailDeposit(key("target", other.ID, fdb), to.ID), from.ID, griperrors.MailWrongTarget},
+		{"no account", mailDeposit(key("account", to.ID, odb), to.ID), other.ID, griperrors.MailNotAllowed},
+		{"no recipient account", mailDeposit(key("recipient", other.ID, fdb), other.ID), from.ID, griperrors.MailNoAccount},
+	}
+	for _, tc := range tests {
+		err := grip.StoreMail(tc.v, tc.from, db)
+		if err != tc.err {
+			t.Errorf("%s: got %v, expected %v", tc.name, err, tc.err)
+		}
+		if held := db.GetMail(tc.v.To, tc.v.Dig) != nil; held != (tc.err == nil) {
+			t.Errorf("%s: held %t", tc.name, held)
+		}
+	}
+}
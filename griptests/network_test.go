@@ -1 +1,487 @@
 package griptests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//WaitUntilSentWithin polls until node 0 and every other node
+//have nothing left to send each other, or the timeout is reached
+func WaitUntilSentWithin(nodes []*gripdata.Node, dbs []*TestDB, timeout time.Duration) bool {
+	end := time.Now().Add(timeout)
+	for time.Now().Before(end) {
+		n := 0
+		for c := 1; c < len(dbs); c++ {
+			n += dbs[0].NumSendDataTo(nodes[c].ID)
+			n += dbs[c].NumSendDataTo(nodes[0].ID)
+		}
+		if n == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+//WaitFor polls until f is true, or the timeout is reached
+func WaitFor(f func() bool, timeout time.Duration) bool {
+	end := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(end) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func createTCPNode(c bool) (*gripdata.MyNodePrivateData, *gripdata.Node, *TestDB, *grip.SocketController) {
+	pn, n, tdb, sctrl := newTCPNode(c)
+	sctrl.Start(context.Background())
+	return pn, n, tdb, sctrl
+}
+
+//newTCPNode a node that has not been started
+func newTCPNode(c bool) (*gripdata.MyNodePrivateData, *gripdata.Node, *TestDB, *grip.SocketController) {
+	var n gripdata.Node
+	var pn gripdata.MyNodePrivateData
+	tdb := NewTestDB()
+	sk, err := grip.ListenTCP("127.0.0.1:0", tdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n.Connectable = c
+	n.URL = sk.Addr().String()
+	grip.CreateNewNode(&pn, &n, tdb)
+	sctrl := grip.NewSocketController(sk, tdb)
+	return &pn, &n, tdb, sctrl
+}
+
+func createTCPNodes(num int) (nodes []*gripdata.Node, pnodes []*gripdata.MyNodePrivateData, dbs []*TestDB, socks []*grip.SocketController) {
+	for c := 0; c < num; c++ {
+		pr, n, db, s := createTCPNode(c == 0)
+		nodes = append(nodes, n)
+		dbs = append(dbs, db)
+		pnodes = append(pnodes, pr)
+		socks = append(socks, s)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	return nodes, pnodes, dbs, socks
+}
+
+func closeSockets(socks []*grip.SocketController) {
+	for _, s := range socks {
+		s.Close()
+	}
+}
+
+//TestTCPNetwork runs nodes on loopback tcp sockets
+func TestTCPNetwork(t *testing.T) {
+	nodes, _, dbs, socks := createTCPNodes(3)
+	defer closeSockets(socks)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send associate node keys")
+	}
+
+	var shr gripdata.ShareNodeInfo
+	shr.Key = "tcpkey"
+	shr.NodeID = nodes[1].ID
+	shr.TargetNodeID = nodes[0].ID
+	err := grip.NewShareNode(&shr, dbs[1])
+	if err != nil {
+		t.Error(err)
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send ShareNodeInfo")
+	}
+
+	var ks gripdata.UseShareNodeKey
+	ks.Key = shr.Key
+	ks.TargetID = nodes[0].ID
+	err = grip.NewUseShareNodeKey(&ks, dbs[2])
+	if err != nil {
+		t.Error(err)
+	}
+	allknown := func() bool {
+		for c := 0; c < 3; c++ {
+			if 3 != len(dbs[c].ListNodes()) {
+				return false
+			}
+		}
+		return true
+	}
+	if !WaitFor(allknown, time.Minute) {
+		t.Error("Nodes were not shared")
+	}
+	for c := 0; c < 3; c++ {
+		if 3 != len(dbs[c].ListNodes()) {
+			t.Errorf("Node %d only knows %d nodes", c, len(dbs[c].ListNodes()))
+		}
+	}
+	if 1 != len(dbs[0].ListUseShareNodeKey(shr.Key)) {
+		t.Error("Node 0 did not get the UseShareNodeKey from node 2")
+	}
+}
+
+//newImpostorDB makes a node that claims to be victim.  If
+//ownkey is set it presents its own public key with the victim's
+//id, otherwise it presents the victim's Node record as is.
+func newImpostorDB(victim *gripdata.Node, ownkey bool) *TestDB {
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	db := NewTestDB()
+	grip.CreateNewNode(&pr, &n, db)
+	pr.ID = victim.ID
+	if ownkey {
+		n.ID = victim.ID
+		grip.CreateNewNode(&pr, &n, db)
+		return db
+	}
+	db.StoreMyPrivateNodeData(victim, &pr)
+	return db
+}
+
+//TestTCPHandshake checks nodes must prove they own their node key
+func TestTCPHandshake(t *testing.T) {
+	_, srv, _, sctrl := createTCPNode(true)
+	defer sctrl.Close()
+
+	var vn gripdata.Node
+	var vpr gripdata.MyNodePrivateData
+	vdb := NewTestDB()
+	grip.CreateNewNode(&vpr, &vn, vdb)
+	vs, err := grip.ListenTCP("127.0.0.1:0", vdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	c, err := vs.ConnectTo(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, ownkey := range []bool{false, true} {
+		ids, err := grip.ListenTCP("127.0.0.1:0", newImpostorDB(&vn, ownkey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err = ids.ConnectTo(srv)
+		if err == nil {
+			c.Close()
+			t.Errorf("Impostor was allowed to connect, own key: %t", ownkey)
+		}
+		ids.Close()
+	}
+}
+
+//TestTCPMalformedHello checks a hello with a truncated or
+//oversized key or signature is rejected without taking down the
+//listening node
+func TestTCPMalformedHello(t *testing.T) {
+	_, srv, _, sctrl := createTCPNode(true)
+	defer sctrl.Close()
+
+	var vn gripdata.Node
+	var vpr gripdata.MyNodePrivateData
+	grip.CreateNewNode(&vpr, &vn, NewTestDB())
+	var bad []gripdata.Node
+	for _, k := range malformedKeys(vn.PublicKey) {
+		n := vn
+		n.PublicKey = k
+		h := sha512.New()
+		h.Write(k)
+		n.ID = h.Sum(nil)
+		bad = append(bad, n)
+	}
+	for _, s := range malformedKeys(vn.Sig) {
+		n := vn
+		n.Sig = s
+		bad = append(bad, n)
+	}
+	for c := range bad {
+		db := NewTestDB()
+		pr := vpr
+		pr.ID = bad[c].ID
+		db.StoreMyPrivateNodeData(&bad[c], &pr)
+		s, err := grip.ListenTCP("127.0.0.1:0", db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cn, err := s.ConnectTo(srv)
+		if err == nil {
+			cn.Close()
+			t.Errorf("Malformed hello was accepted: %d", c)
+		}
+		s.Close()
+	}
+
+	vdb := NewTestDB()
+	grip.CreateNewNode(&vpr, &vn, vdb)
+	vs, err := grip.ListenTCP("127.0.0.1:0", vdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	cn, err := vs.ConnectTo(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+}
+
+//TestTCPEncrypted checks an eavesdropper only sees ciphertext
+func TestTCPEncrypted(t *testing.T) {
+	var an, bn gripdata.Node
+	var apr, bpr gripdata.MyNodePrivateData
+	adb := NewTestDB()
+	bdb := NewTestDB()
+	grip.CreateNewNode(&apr, &an, adb)
+	grip.CreateNewNode(&bpr, &bn, bdb)
+
+	ac, bc := net.Pipe()
+	tap := NewTapConn(ac)
+	var b *grip.NetConnection
+	var berr error
+	done := make(chan bool)
+	go func() {
+		b, berr = grip.NewNetConnection(bc, nil, bdb)
+		close(done)
+	}()
+	a, err := grip.NewNetConnection(tap, bn.ID, adb)
+	<-done
+	if err != nil || berr != nil {
+		t.Fatal(err, berr)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	secret := "the secret account key"
+	var ak gripdata.AssociateNodeAccountKey
+	ak.Key = secret
+	ak.NodeID = an.ID
+	ak.TargetNodeID = bn.ID
+	go a.Send(&ak)
+	d, err := b.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rak, ok := d.(*gripdata.AssociateNodeAccountKey)
+	if !ok || rak.Key != secret {
+		t.Fatal("Message was not received")
+	}
+	if bytes.Contains(tap.Seen(), []byte(secret)) {
+		t.Error("Eavesdropper saw the plaintext key")
+	}
+	if !bytes.Contains(tap.Seen(), an.ID) {
+		t.Error("Eavesdropper did not see the handshake")
+	}
+}
+
+//TestTCPAddresses checks the addresses are tried in order and the
+//one that worked is remembered
+func TestTCPAddresses(t *testing.T) {
+	var srv gripdata.Node
+	var spr gripdata.MyNodePrivateData
+	sdb := NewTestDB()
+	sk, err := grip.ListenTCP("127.0.0.1:0", sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	live := "tcp://" + sk.Addr().String()
+	srv.Connectable = true
+	srv.Addresses = []gripdata.NodeAddress{
+		{URL: live, Priority: 2},
+		{URL: dead.Addr().String(), Priority: 1},
+	}
+	grip.CreateNewNode(&spr, &srv, sdb)
+	sctrl := grip.NewSocketController(sk, sdb)
+	sctrl.Start(context.Background())
+	defer sctrl.Close()
+	ul := grip.NodeURLs(&srv)
+	if len(ul) != 2 || ul[0] != dead.Addr().String() || ul[1] != live {
+		t.Errorf("Addresses in the wrong order: %v", ul)
+	}
+
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	db := NewTestDB()
+	grip.CreateNewNode(&pr, &n, db)
+	db.StoreNode(&srv)
+	db.CreateNodeEphemera(srv.ID, true)
+	s, err := grip.ListenTCP("127.0.0.1:0", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := s.ConnectTo(&srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if db.GetNodeEphemera(srv.ID).LastAddress != live {
+		t.Error("Working address not recorded")
+	}
+}
+
+//TestTCPIncompatibleVersion checks a node that speaks no common
+//protocol version is disconnected and not retried soon
+func TestTCPIncompatibleVersion(t *testing.T) {
+	_, srv, sdb, sctrl := createTCPNode(true)
+	defer sctrl.Close()
+
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	db := NewTestDB()
+	grip.CreateNewNode(&pr, &n, db)
+	s, err := grip.ListenTCP("127.0.0.1:0", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := s.ConnectTo(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	intro := grip.NewIntroduction(&n)
+	intro.Version = grip.PROTOCOLVERSION + 10
+	intro.MinVersion = grip.PROTOCOLVERSION + 10
+	err = c.Send(intro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(grip.Introduction); !ok {
+		t.Fatal("Node did not introduce itself first")
+	}
+	_, err = c.Read()
+	if err == nil {
+		t.Error("Incompatible connection was not closed")
+	}
+	ep := sdb.GetNodeEphemera(n.ID)
+	if ep == nil || ep.NextAttempt < uint64(time.Now().Add(grip.INCOMPATIBLERETRY/2).UnixNano()) {
+		t.Error("Incompatible node will be retried too soon")
+	}
+}
+
+func TestNegotiateIntroduction(t *testing.T) {
+	var a, b grip.Introduction
+	a.Version, a.MinVersion = 3, 1
+	b.Version, b.MinVersion = 2, 2
+	a.Capabilities = []string{"x", "y"}
+	b.Capabilities = []string{"y", "z"}
+	v, f, err := grip.NegotiateIntroduction(a, b)
+	if err != nil || v != 2 {
+		t.Errorf("Expected version 2, got %d %v", v, err)
+	}
+	if len(f) != 1 || !f["y"] {
+		t.Errorf("Expected only y in common, got %v", f)
+	}
+	b.MinVersion, b.Version = 4, 5
+	if _, _, err = grip.NegotiateIntroduction(a, b); err == nil {
+		t.Error("Incompatible versions were accepted")
+	}
+}
+
+//TestTCPShutdown checks Shutdown and a cancelled context stop
+//every routine a node started
+func TestTCPShutdown(t *testing.T) {
+	nodes, _, dbs, socks := createTCPNodes(3)
+	defer closeSockets(socks)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send associate node keys")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := socks[0].Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Shutdown failed, still running: %v", socks[0].RunningRoutines())
+	}
+
+	_, _, _, sctrl := newTCPNode(false)
+	sctx, scancel := context.WithCancel(context.Background())
+	sctrl.Start(sctx)
+	sctrl.Start(sctx)
+	scancel()
+	stopped := func() bool {
+		return len(sctrl.RunningRoutines()) == 0
+	}
+	if !WaitFor(stopped, 10*time.Second) {
+		t.Errorf("Cancel did not stop: %v", sctrl.RunningRoutines())
+	}
+}
+
+//TestTCPDeadPeer checks a node that stops answering is pinged,
+//then closed once it has been silent too long
+func TestTCPDeadPeer(t *testing.T) {
+	_, srv, sdb, sctrl := newTCPNode(true)
+	sctrl.PingInterval = 200 * time.Millisecond
+	sctrl.PeerTimeout = time.Second
+	sctrl.Start(context.Background())
+	defer sctrl.Close()
+
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	db := NewTestDB()
+	grip.CreateNewNode(&pr, &n, db)
+	s, err := grip.ListenTCP("127.0.0.1:0", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := s.ConnectTo(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Send(grip.NewIntroduction(&n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinged := make(chan bool, 1)
+	go func() {
+		p := false
+		for {
+			d, err := c.Read()
+			if err != nil {
+				pinged <- p
+				return
+			}
+			if _, ok := d.(grip.Ping); ok {
+				p = true
+			}
+		}
+	}()
+	select {
+	case p := <-pinged:
+		if !p {
+			t.Error("Silent node was never pinged")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Silent node was not disconnected")
+	}
+	closed := func() bool {
+		ep := sdb.GetNodeEphemera(n.ID)
+		return ep != nil && !ep.Connected
+	}
+	if !WaitFor(closed, 5*time.Second) {
+		t.Error("Node Ephemera still says connected")
+	}
+}
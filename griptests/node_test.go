@@ -1,13 +1,17 @@
 package griptests
 
 import (
+	"bytes"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"testing"
 
 	"github.com/wyathan/grip"
 
+	"github.com/wyathan/grip/gripcrypto"
 	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
 )
 
 type TestNodeDb struct {
@@ -29,6 +33,9 @@ func (a *TestNodeDb) GetShareNodeInfo(id []byte, target []byte) *gripdata.ShareN
 func (a *TestNodeDb) StoreNode(n *gripdata.Node) error {
 	return nil
 }
+func (a *TestNodeDb) SetNodeEphemeraAddress(id []byte, url string) error {
+	return nil
+}
 func (a *TestNodeDb) StoreMyPrivateNodeData(n *gripdata.Node, pr *gripdata.MyNodePrivateData) error {
 	return nil
 }
@@ -56,6 +63,12 @@ func (a *TestNodeDb) StoreSendData(s *gripdata.SendData) error {
 func (a *TestNodeDb) StoreRejectedSendData(s *gripdata.RejectedSendData) error {
 	return nil
 }
+func (a *TestNodeDb) ListRejectedSendData(target []byte, typename string) []gripdata.RejectedSendData {
+	return nil
+}
+func (a *TestNodeDb) DeleteRejectedSendData(d []byte, target []byte) error {
+	return nil
+}
 func (a *TestNodeDb) GetSendData(target []byte, max int) []gripdata.SendData {
 	return nil
 }
@@ -68,6 +81,9 @@ func (a *TestNodeDb) GetDigestData(d []byte) interface{} {
 func (a *TestNodeDb) GetConnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera {
 	return nil
 }
+func (a *TestNodeDb) GetUnconnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera {
+	return nil
+}
 func (a *TestNodeDb) GetConnectableNodesWithShareNodeKey(max int, curtime uint64) []gripdata.NodeEphemera {
 	return nil
 }
@@ -86,6 +102,9 @@ func (a *TestNodeDb) CreateNodeEphemera(id []byte, connectable bool) error {
 func (a *TestNodeDb) SetNodeEphemeraNextConnection(id []byte, last uint64, next uint64) error {
 	return nil
 }
+func (a *TestNodeDb) SetNodeEphemeraFailed(id []byte, last uint64, next uint64) error {
+	return nil
+}
 func (a *TestNodeDb) ClearAllConnected() {
 }
 func (a *TestNodeDb) CanNodeEphemeraGoPending(id []byte) bool {
@@ -151,6 +170,15 @@ func (a *TestNodeDb) GetContextLeaves(cid []byte, covered bool, index bool) []*g
 func (a *TestNodeDb) GetCoveredSnapshots(cid []byte) []*gripdata.ContextFileWrap {
 	return nil
 }
+func (a *TestNodeDb) GetNodeContexts(id []byte) [][]byte {
+	return nil
+}
+func (a *TestNodeDb) GetContextFiles(cid []byte) []*gripdata.ContextFileWrap {
+	return nil
+}
+func (a *TestNodeDb) GetContextFilesDeleted(cid []byte) []*gripdata.DeletedContextFile {
+	return nil
+}
 func (t *TestNodeDb) CheckUpdateStorageUsed(a *gripdata.Account, fsize uint64) error {
 	return nil
 }
@@ -160,6 +188,36 @@ func (t *TestNodeDb) FreeStorageUsed(a *gripdata.Account, fsize uint64) (*gripda
 func (t *TestNodeDb) SetAccountMessage(a *gripdata.Account, msg string) error {
 	return nil
 }
+func (t *TestNodeDb) CheckUpdateRelayUsed(a *gripdata.Account, n uint64) error {
+	return nil
+}
+func (t *TestNodeDb) StoreMail(m *gripdata.Mail) error {
+	return nil
+}
+func (t *TestNodeDb) GetMail(to []byte, dig []byte) *gripdata.Mail {
+	return nil
+}
+func (t *TestNodeDb) ListMail(to []byte, max int) []gripdata.Mail {
+	return nil
+}
+func (t *TestNodeDb) SetMailDelivered(to []byte, dig []byte, msg string, code int) (*gripdata.Mail, error) {
+	return nil, nil
+}
+func (t *TestNodeDb) ListMailDelivered(from []byte, max int) []gripdata.Mail {
+	return nil
+}
+func (t *TestNodeDb) DeleteMail(to []byte, dig []byte) error {
+	return nil
+}
+func (t *TestNodeDb) StoreMailDeposited(d *gripdata.MailDeposited) error {
+	return nil
+}
+func (t *TestNodeDb) GetMailDeposited(mailbox []byte, to []byte, dig []byte) *gripdata.MailDeposited {
+	return nil
+}
+func (t *TestNodeDb) DeleteMailDeposited(mailbox []byte, to []byte, dig []byte) error {
+	return nil
+}
 func (t *TestNodeDb) StoreAccount(a *gripdata.Account) error {
 	return nil
 }
@@ -224,3 +282,112 @@ func TestNodeCreateVerify(t *testing.T) {
 	fmt.Println(hex.EncodeToString(n.ID))
 	fmt.Println(hex.EncodeToString(pr.ID))
 }
+
+//oldNode digests a Node the way it was before Seq and Addresses
+type oldNode struct {
+	gripdata.Node
+}
+
+func (a *oldNode) Digest() []byte {
+	h := sha512.New()
+	gripcrypto.HashBool(h, a.Connectable)
+	gripcrypto.HashBytes(h, a.ID)
+	gripcrypto.HashString(h, a.MetaData)
+	gripcrypto.HashString(h, a.Name)
+	gripcrypto.HashBytes(h, a.PublicKey)
+	gripcrypto.HashString(h, a.URL)
+	a.Dig = h.Sum(nil)
+	return a.Dig
+}
+
+//TestOldNodeDigest checks a Node signed before Seq and Addresses
+//were added still verifies
+func TestOldNodeDigest(t *testing.T) {
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	n.Name = "old node"
+	n.URL = "tcp://127.0.0.1:1"
+	grip.CreateNewNode(&pr, &n, NewTestDB())
+	var o oldNode
+	o.Node = n
+	o.Seq = 0
+	o.Addresses = nil
+	err := gripcrypto.Sign(&o, pr.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	on := o.Node
+	_, err = grip.VerifyNode(&on, nil)
+	if err != nil {
+		t.Errorf("Old node did not verify: %s", err)
+	}
+	if !bytes.Equal(on.Dig, o.Dig) {
+		t.Error("Old node digest changed")
+	}
+	on.Seq = 1
+	_, err = grip.VerifyNode(&on, nil)
+	if err != griperrors.InvalidSignature {
+		t.Errorf("Node with a new Seq verified with the old signature: %v", err)
+	}
+}
+
+//TestUpdateMyNode checks an updated Node is sent to the nodes we
+//share with and an older one cannot replace it
+func TestUpdateMyNode(t *testing.T) {
+	var n0, n1 gripdata.Node
+	var pr0, pr1 gripdata.MyNodePrivateData
+	n0.Name = "old name"
+	db0 := NewTestDB()
+	db1 := NewTestDB()
+	grip.CreateNewNode(&pr0, &n0, db0)
+	grip.CreateNewNode(&pr1, &n1, db1)
+	old := n0
+	err := grip.IncomingNode(&n0, db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = grip.IncomingNode(&n1, db0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shr gripdata.ShareNodeInfo
+	shr.TargetNodeID = n1.ID
+	err = grip.NewShareNode(&shr, db0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var un gripdata.Node
+	un.Name = "new name"
+	un.URL = "tcp://127.0.0.1:2"
+	err = grip.UpdateMyNode(&un, db0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if un.Seq != old.Seq+1 || !bytes.Equal(un.ID, old.ID) {
+		t.Error("Update is not the next version of the node")
+	}
+	queued := false
+	for _, sd := range db0.GetSendData(n1.ID, 100) {
+		queued = queued || bytes.Equal(sd.Dig, un.Dig)
+	}
+	if !queued {
+		t.Error("Update not sent to the node we share with")
+	}
+
+	err = grip.IncomingNode(&un, db1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = grip.IncomingNode(&old, db1)
+	if err != griperrors.NodeOutdated {
+		t.Errorf("Old node record not rejected: %v", err)
+	}
+	if db1.GetNode(n0.ID).Name != "new name" {
+		t.Error("Old node record replaced the update")
+	}
+	err = grip.IncomingNode(&un, db1)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,7 @@
 package griptests
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -31,7 +32,10 @@ func createNewNode(idx int, c bool, tn *TestNetwork) (*gripdata.MyNodePrivateDat
 	NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = idx
 	sk := tn.Open(n.ID, idx)
 	sctrl := grip.NewSocketController(sk, tdb)
-	sctrl.Start()
+	if tn.Setup != nil {
+		tn.Setup(sctrl)
+	}
+	sctrl.Start(context.Background())
 	SOCKETS = append(SOCKETS, sctrl)
 	return &pn, &n, tdb
 }
@@ -83,17 +87,28 @@ func WaitUntilAllSent(dbs []*TestDB) bool {
 func createSomeNodes(num int) (tn *TestNetwork, nodes []*gripdata.Node, pnodes []*gripdata.MyNodePrivateData, dbs []*TestDB) {
 	clearTestGlobals()
 	tn = InitTestNetwork()
-	ct := uint64(time.Now().UnixNano()) + (10 * uint64(time.Minute))
 	for c := 0; c < num; c++ {
 		pr, n, db := createNewNode(c, c == 0, tn)
 		nodes = append(nodes, n)
 		dbs = append(dbs, db)
 		pnodes = append(pnodes, pr)
 	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilAllSent(dbs) {
+		log.Fatal("Failed to send assocate node key")
+	}
+	log.Printf("<<<<<<<<<<<<<<<<<<<<<<< %d nodes created <<<<<<<<<<<<<<<<<<<<<<<<<", num)
+	return tn, nodes, pnodes, dbs
+}
+
+//associateWithNodeZero create accounts for every node on node 0
+//and have each node associate with its account
+func associateWithNodeZero(nodes []*gripdata.Node, pnodes []*gripdata.MyNodePrivateData, dbs []*TestDB) {
+	ct := uint64(time.Now().UnixNano()) + (10 * uint64(time.Minute))
 	pnodes[0].AutoShareNodeInfo = false
 	pnodes[0].AutoContextResponse = true
 
-	for c := 1; c < num; c++ {
+	for c := 1; c < len(nodes); c++ {
 		grip.IncomingNode(nodes[0], dbs[c])
 		var a gripdata.Account
 		var na gripdata.NodeAccountKey
@@ -122,11 +137,6 @@ func createSomeNodes(num int) (tn *TestNetwork, nodes []*gripdata.Node, pnodes [
 
 		grip.AssociateNodeAccoutKey(na.Key, nodes[0].ID, dbs[c])
 	}
-	if !WaitUntilAllSent(dbs) {
-		log.Fatal("Failed to send assocate node key")
-	}
-	log.Printf("<<<<<<<<<<<<<<<<<<<<<<< %d nodes created <<<<<<<<<<<<<<<<<<<<<<<<<", num)
-	return tn, nodes, pnodes, dbs
 }
 
 //TestNodeShare does that
@@ -364,5 +374,16 @@ func TestNodeShare(t *testing.T) {
 		t.Errorf("Missing nodes %d", len(dbs[9].Nodes))
 	}
 
+	//Records are not offered back to the nodes they came from
+	var skipped uint64
+	for _, s := range SOCKETS {
+		skipped += s.Seen.Skipped()
+	}
+	log.Printf("Skipped %d SendData, sent %d CheckDig %d CheckDigs", skipped,
+		tn.Messages("CheckDig"), tn.Messages("CheckDigs"))
+	if skipped == 0 {
+		t.Error("No SendData skipped")
+	}
+
 	tn.CloseAll()
 }
@@ -0,0 +1,167 @@
+package griptests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//sendRequestFirst starts two nodes where node 1 sends node 0 a
+//ContextRequest before its Context.  setup is called on each
+//SocketController before it starts.
+func sendRequestFirst(t *testing.T, tn *TestNetwork, setup func(c int, s *grip.SocketController)) ([]*gripdata.Node, []*TestDB, *gripdata.Context) {
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+
+	var ctx gripdata.Context
+	ctx.Name = "orphancontext"
+	err := grip.NewContext(&ctx, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rq gripdata.ContextRequest
+	rq.ContextDig = ctx.Dig
+	rq.TargetNodeID = nodes[0].ID
+	err = grip.NewContextRequest(&rq, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Nothing is sent yet, so put the request ahead of the Context
+	tk := base64.StdEncoding.EncodeToString(nodes[0].ID)
+	sl := dbs[1].SendData[tk]
+	ci, ri := -1, -1
+	for i, s := range sl {
+		if bytes.Equal(s.Dig, ctx.Dig) {
+			ci = i
+		}
+		if bytes.Equal(s.Dig, rq.Dig) {
+			ri = i
+		}
+	}
+	if ci < 0 || ri < ci {
+		t.Fatalf("Unexpected send order: %d %d", ci, ri)
+	}
+	sl[ci], sl[ri] = sl[ri], sl[ci]
+
+	for c := 0; c < 2; c++ {
+		s := grip.NewSocketController(tn.Open(nodes[c].ID, c), dbs[c])
+		setup(c, s)
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+	}
+	return nodes, dbs, &ctx
+}
+
+//TestOrphanRecord node 0 holds the ContextRequest until the Context
+//comes instead of rejecting it
+func TestOrphanRecord(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	nodes, dbs, ctx := sendRequestFirst(t, tn, func(c int, s *grip.SocketController) {})
+	tk := base64.StdEncoding.EncodeToString(nodes[0].ID)
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, time.Minute) {
+		t.Fatal("Node 0 did not respond to the request")
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Error("Failed to send everything")
+	}
+	if len(dbs[1].RejectedData[tk]) != 0 {
+		t.Errorf("Node 0 rejected %d records", len(dbs[1].RejectedData[tk]))
+	}
+	if SOCKETS[0].Orphans.Len() != 0 {
+		t.Errorf("%d records still waiting", SOCKETS[0].Orphans.Len())
+	}
+}
+
+//TestOrphanOtherConnection node 1's ContextRequest waits on node 0
+//until node 2 brings the Context over its own connection.  Nothing
+//else is read from node 1 to wake it.
+func TestOrphanOtherConnection(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 3; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+
+	var ctx gripdata.Context
+	ctx.Name = "othercontext"
+	err := grip.NewContext(&ctx, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rq gripdata.ContextRequest
+	rq.ContextDig = ctx.Dig
+	rq.TargetNodeID = nodes[0].ID
+	err = grip.NewContextRequest(&rq, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs[1].DeleteSendData(ctx.Dig, nodes[0].ID)
+	grip.IncomingNode(nodes[1], dbs[2])
+	err = grip.IncomingContext(&ctx, dbs[2])
+	if err == nil {
+		err = grip.CreateNewSend(&ctx, nodes[0].ID, dbs[2])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(c int) {
+		s := grip.NewSocketController(tn.Open(nodes[c].ID, c), dbs[c])
+		s.PingInterval = time.Hour
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+	}
+	start(0)
+	start(1)
+	if !WaitFor(func() bool {
+		return SOCKETS[0].Orphans.Len() == 1
+	}, time.Minute) {
+		t.Fatal("ContextRequest is not waiting for its Context")
+	}
+	start(2)
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, 10*time.Second) {
+		t.Fatal("ContextRequest still waiting after its Context came")
+	}
+	if SOCKETS[0].Orphans.Len() != 0 {
+		t.Errorf("%d records still waiting", SOCKETS[0].Orphans.Len())
+	}
+}
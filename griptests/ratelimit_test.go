@@ -0,0 +1,135 @@
+package griptests
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+func TestRateLimit(t *testing.T) {
+	r := grip.NewRateLimit(1000)
+	r.Take(1000)
+	if r.Wait() != 0 {
+		t.Error("Waiting with a full bucket")
+	}
+	r.Take(500)
+	w := r.Wait()
+	if w < 400*time.Millisecond || w > 500*time.Millisecond {
+		t.Errorf("Wait %s for 500 bytes at 1000 per second", w)
+	}
+	sent, rate := r.Throughput()
+	if sent != 1500 || rate <= 0 {
+		t.Errorf("Throughput %d bytes at %f", sent, rate)
+	}
+	u := grip.NewRateLimit(0)
+	u.Take(1 << 30)
+	if u.Wait() != 0 {
+		t.Error("Unlimited bucket waited")
+	}
+	var n *grip.RateLimit
+	n.Take(10)
+	if n.Wait() != 0 {
+		t.Error("Nil bucket waited")
+	}
+}
+
+//TestBandwidthLimit checks file data is held to the connection's
+//file limit and shows up in the throughput
+func TestBandwidthLimit(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	const rate = 256 * 1024
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 2; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		s := grip.NewSocketController(tn.Open(n.ID, c), db)
+		if c == 1 {
+			s.Bandwidth.ConnectionFiles = rate
+		}
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send associate node keys")
+	}
+	a := *dbs[0].GetAccount("node1")
+	a.MaxDiskSpace = 16 * 1024 * 1024
+	dbs[0].StoreAccount(&a)
+
+	var ctx gripdata.Context
+	ctx.Name = "ratelimit"
+	err := grip.NewContext(&ctx, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rq gripdata.ContextRequest
+	rq.ContextDig = ctx.Dig
+	rq.TargetNodeID = nodes[0].ID
+	err = grip.NewContextRequest(&rq, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send context request")
+	}
+
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	tf, err := ioutil.TempFile("", "grip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.Write(data)
+	tf.Close()
+	defer os.Remove(tf.Name())
+	var f gripdata.ContextFile
+	f.Context = ctx.Dig
+	f.Snapshot = true
+	f.NodeID = nodes[1].ID
+	f.Size = uint64(len(data))
+	f.SetPath(tf.Name())
+	start := time.Now()
+	err = grip.NewContextFile(&f, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(grip.ContextFileDataPath(pnodes[0], &f))
+	got := func() bool {
+		return dbs[0].GetDigestData(f.Dig) != nil
+	}
+	if !WaitFor(got, time.Minute) {
+		t.Fatal("Node 0 did not get the file")
+	}
+	//The bucket starts with one second of tokens
+	least := time.Duration(len(data)-rate) * time.Second / rate
+	if el := time.Since(start); el < least {
+		t.Errorf("File sent in %s, the limit allows no less than %s", el, least)
+	}
+	tp := SOCKETS[1].Throughput()
+	if tp.FileSent < uint64(len(data)) || tp.Sent < tp.FileSent {
+		t.Errorf("Throughput shows %d bytes of file data of %d sent", tp.FileSent, tp.Sent)
+	}
+	if SOCKETS[0].Throughput().FileSent != 0 {
+		t.Error("File data counted on the receiving node")
+	}
+}
@@ -0,0 +1,74 @@
+package griptests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	b := grip.TRYCONNECTAGAINAFTERFAIL
+	for f := uint32(1); f < 40; f++ {
+		lo := time.Duration(float64(b) * (1 - grip.RECONNECTJITTER))
+		hi := time.Duration(float64(b) * (1 + grip.RECONNECTJITTER))
+		if d := grip.ReconnectBackoff(f); d < lo || d > hi {
+			t.Errorf("Backoff after %d failures %s, expected about %s", f, d, b)
+		}
+		b *= 2
+		if b > grip.MAXRECONNECTBACKOFF {
+			b = grip.MAXRECONNECTBACKOFF
+		}
+	}
+
+	var e gripdata.NodeEphemera
+	if grip.NodeHealth(&e) != 1 {
+		t.Error("Untried node should be healthy")
+	}
+	e.LastConnAttempt = 10
+	e.ConnFailures = 2
+	if grip.NodeHealth(&e) != 0.25 {
+		t.Errorf("Expected 0.25 health, got %f", grip.NodeHealth(&e))
+	}
+	e.LastConnection = 11
+	if grip.NodeHealth(&e) != 1 {
+		t.Error("Node we connected to after failing should be healthy")
+	}
+}
+
+//TestUnreachableBackoff checks a node we cannot reach is tried
+//less and less often, and the failures are kept in the database
+func TestUnreachableBackoff(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer func() {
+		for _, s := range SOCKETS {
+			s.Close()
+		}
+	}()
+	_, _, db := createNewNode(0, false, tn)
+
+	//Never opened on the network
+	var n gripdata.Node
+	var pr gripdata.MyNodePrivateData
+	n.Connectable = true
+	grip.CreateNewNode(&pr, &n, NewTestDB())
+	db.StoreNode(&n)
+	db.CreateNodeEphemera(n.ID, true)
+
+	failed := func() bool {
+		return db.GetNodeEphemera(n.ID).ConnFailures >= 3
+	}
+	if !WaitFor(failed, 30*time.Second) {
+		t.Fatal("Unreachable node was not tried")
+	}
+	ep := db.GetNodeEphemera(n.ID)
+	wait := time.Duration(ep.NextAttempt - ep.LastConnAttempt)
+	//The third failure waits four times as long as the first
+	min := time.Duration(float64(4*grip.TRYCONNECTAGAINAFTERFAIL) * (1 - grip.RECONNECTJITTER))
+	if wait < min {
+		t.Errorf("Waiting %s after %d failures", wait, ep.ConnFailures)
+	}
+}
@@ -0,0 +1,93 @@
+package griptests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//noOrphans node 0 rejects records it cannot process right away.
+//Node 1 shows the reasons in Spanish.
+func noOrphans(retry time.Duration) func(c int, s *grip.SocketController) {
+	return func(c int, s *grip.SocketController) {
+		s.Orphans.Max = 0
+		s.RejectRetry = retry
+		if c == 1 {
+			_, pr := s.DB.GetPrivateNodeData()
+			pr.Locale = griperrors.EsMx
+		}
+	}
+}
+
+//TestRejectedRequeue the ContextRequest is rejected because node 0
+//does not have the Context yet.  It is listed with its reason and
+//accepted once it is requeued.
+func TestRejectedRequeue(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	nodes, dbs, ctx := sendRequestFirst(t, tn, noOrphans(0))
+	if !WaitFor(func() bool {
+		return len(dbs[1].ListRejectedSendData(nodes[0].ID, "ContextRequest")) == 1
+	}, time.Minute) {
+		t.Fatal("ContextRequest was not rejected")
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send the Context")
+	}
+	rl := dbs[1].ListRejectedSendData(nodes[0].ID, "")
+	if len(rl) != 1 || len(dbs[1].ListRejectedSendData(nil, "Context")) != 0 {
+		t.Fatalf("Expected only the ContextRequest to be rejected: %v", rl)
+	}
+	r := rl[0]
+	want := griperrors.ByCode(r.Code)
+	if want != griperrors.ContextNotFound || r.Message != want.In(griperrors.EsMx) {
+		t.Errorf("Unexpected reason: %d %s", r.Code, r.Message)
+	}
+	if !griperrors.IsTransient(r.Code) || griperrors.IsTransient(griperrors.Code(griperrors.NotContextSource)) {
+		t.Error("Wrong reasons are transient")
+	}
+	n, err := grip.RetryRejected(dbs[1], time.Hour, grip.MAXREJECTRETRIES, r.Timestamp)
+	if err != nil || n != 0 {
+		t.Errorf("Retried too soon: %d %v", n, err)
+	}
+
+	err = grip.RequeueRejectedSendData(&r, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs[1].ListRejectedSendData(nil, "")) != 0 {
+		t.Error("Requeued data is still listed")
+	}
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, time.Minute) {
+		t.Error("Requeued ContextRequest was not accepted")
+	}
+}
+
+//TestRejectedRetry transient rejections are sent again on their own
+func TestRejectedRetry(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer tn.CloseAll()
+	nodes, dbs, ctx := sendRequestFirst(t, tn, noOrphans(200*time.Millisecond))
+	if !WaitFor(func() bool {
+		return dbs[1].GetContextResponse(ctx.Dig, nodes[0].ID) != nil
+	}, time.Minute) {
+		t.Fatal("Rejected ContextRequest was not sent again")
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Error("Failed to send everything")
+	}
+	for _, r := range dbs[1].ListRejectedSendData(nil, "") {
+		if bytes.Equal(r.Dig, ctx.Dig) || griperrors.IsTransient(r.Code) {
+			t.Errorf("Still rejected: %s", r.Message)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package griptests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//TestRelay checks two nodes that cannot be dialed reach each other
+//through a connectable node they both share with
+func TestRelay(t *testing.T) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	defer func() {
+		for _, s := range SOCKETS {
+			s.Close()
+		}
+	}()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 3; c++ {
+		var n gripdata.Node
+		var pn gripdata.MyNodePrivateData
+		n.Connectable = c == 0
+		db := NewTestDB()
+		grip.CreateNewNode(&pn, &n, db)
+		NODEMAP[base64.StdEncoding.EncodeToString(n.ID)] = c
+		s := grip.NewSocketController(tn.Open(n.ID, c), db)
+		if c == 0 {
+			s.Relay = &grip.RelayLimits{MaxSessions: 10}
+		}
+		s.Start(context.Background())
+		SOCKETS = append(SOCKETS, s)
+		nodes = append(nodes, &n)
+		pnodes = append(pnodes, &pn)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Associate node keys stuck")
+	}
+	for c := 1; c < 3; c++ {
+		dbs[0].GetAccount(fmt.Sprintf("node%d", c)).MaxRelayBytes = 1024 * 1024
+	}
+	for c := 1; c < 3; c++ {
+		var shr gripdata.ShareNodeInfo
+		shr.NodeID = nodes[c].ID
+		shr.TargetNodeID = nodes[0].ID
+		err := grip.NewShareNode(&shr, dbs[c])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("ShareNodeInfo stuck")
+	}
+
+	dbs[1].StoreNode(nodes[2])
+	dbs[1].CreateNodeEphemera(nodes[2].ID, false)
+	err := grip.CreateNewSend(nodes[1], nodes[2].ID, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := func() bool {
+		return dbs[1].NumSendDataTo(nodes[2].ID) == 0
+	}
+	if !WaitFor(sent, time.Minute) {
+		t.Fatal("Data not sent through the relay")
+	}
+	cc := getConnection(SOCKETS[1], nodes[2].ID)
+	if cc == nil {
+		t.Fatal("Relayed connection not kept")
+	}
+	if _, ok := cc.C.(*grip.RelayConnection); !ok {
+		t.Error("Connection is not relayed")
+	}
+	if dbs[2].GetNode(nodes[1].ID) == nil {
+		t.Error("Node not received through the relay")
+	}
+	for c := 1; c < 3; c++ {
+		if dbs[0].GetAccount(fmt.Sprintf("node%d", c)).RelayBytesUsed > 0 {
+			return
+		}
+	}
+	t.Error("Relayed bytes not charged to an account")
+}
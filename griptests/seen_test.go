@@ -0,0 +1,140 @@
+package griptests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//TestSeenCache the oldest digests are forgotten first, and what is
+//seen, and no more, is loaded again from the DB
+func TestSeenCache(t *testing.T) {
+	db := NewTestDB()
+	c := grip.NewSeenCache(3)
+	c.Persist(db)
+	a, b := []byte("node a"), []byte("node b")
+	for i := byte(0); i < 4; i++ {
+		c.Add([]byte{i}, a)
+	}
+	c.Add([]byte{3}, b)
+	c.Add([]byte{3}, b)
+	if c.Len() != 3 || c.Has([]byte{0}, a) || !c.Has([]byte{1}, a) {
+		t.Errorf("Oldest digest not forgotten: %d", c.Len())
+	}
+	if !c.Has([]byte{3}, b) || c.Has([]byte{2}, b) {
+		t.Error("Wrong node for digest")
+	}
+	if len(db.SeenDigs) != 4 {
+		t.Errorf("Unexpected stored: %d", len(db.SeenDigs))
+	}
+
+	for i := 0; i < grip.SEENPERDIG; i++ {
+		c.Add([]byte{2}, []byte{byte(i)})
+	}
+	if c.Has([]byte{2}, a) || !c.Has([]byte{2}, []byte{0}) {
+		t.Error("Too many nodes kept for a digest")
+	}
+	c.Forget([]byte{3}, b)
+	if c.Has([]byte{3}, b) || !c.Has([]byte{3}, a) {
+		t.Error("Forget removed the wrong node")
+	}
+
+	if len(db.SeenDigs) != 2+grip.SEENPERDIG {
+		t.Errorf("Forgotten digests still stored: %d", len(db.SeenDigs))
+	}
+
+	l := grip.NewSeenCache(2)
+	l.Persist(db)
+	if l.Len() != 2 || !l.Has([]byte{2}, []byte{byte(grip.SEENPERDIG - 1)}) || !l.Has([]byte{3}, a) {
+		t.Errorf("Unexpected after loading: %d", l.Len())
+	}
+	if l.Has([]byte{3}, b) || l.Has([]byte{1}, a) {
+		t.Error("Forgotten digest loaded as seen")
+	}
+	if len(db.SeenDigs) != 1+grip.SEENPERDIG {
+		t.Errorf("Digests that did not fit still stored: %d", len(db.SeenDigs))
+	}
+}
+
+//seenShare has node 1 share itself with node 2 through node 0.
+//It returns the SendData the seen caches skipped, and the
+//CheckDig(s) sent after the nodes were associated.
+func seenShare(t *testing.T, setup func(s *grip.SocketController)) (uint64, int) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = 0
+	tn.Setup = setup
+	defer tn.CloseAll()
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < 3; c++ {
+		pr, n, db := createNewNode(c, c == 0, tn)
+		nodes = append(nodes, n)
+		pnodes = append(pnodes, pr)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Associate node keys stuck")
+	}
+	before := tn.Messages("CheckDig") + tn.Messages("CheckDigs")
+
+	var shr gripdata.ShareNodeInfo
+	shr.Key = "abcd123"
+	shr.NodeID = nodes[1].ID
+	shr.TargetNodeID = nodes[0].ID
+	err := grip.NewShareNode(&shr, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send ShareNodeInfo")
+	}
+	var ks gripdata.UseShareNodeKey
+	ks.Key = shr.Key
+	ks.TargetID = nodes[0].ID
+	err = grip.NewUseShareNodeKey(&ks, dbs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	allknown := func() bool {
+		for c := 0; c < 3; c++ {
+			if 3 != len(dbs[c].ListNodes()) {
+				return false
+			}
+		}
+		return true
+	}
+	if !WaitFor(allknown, time.Minute) {
+		t.Fatal("Nodes were not shared")
+	}
+	if !WaitUntilSentWithin(nodes, dbs, time.Minute) {
+		t.Fatal("Failed to send UseShareNodeKey")
+	}
+	var skipped uint64
+	for _, s := range SOCKETS {
+		if s.Seen != nil {
+			skipped += s.Seen.Skipped()
+		}
+	}
+	return skipped, tn.Messages("CheckDig") + tn.Messages("CheckDigs") - before
+}
+
+//TestSeenShare checks the seen cache stops records being offered
+//back to the nodes they came from.  The network does not fail, so
+//the counts are the same every run.
+func TestSeenShare(t *testing.T) {
+	skipped, plain := seenShare(t, func(s *grip.SocketController) {
+		s.Seen = nil
+	})
+	if skipped != 0 || plain != 6 {
+		t.Errorf("Without the seen cache %d skipped, %d CheckDig(s) sent", skipped, plain)
+	}
+	skipped, cached := seenShare(t, nil)
+	if skipped != 12 || cached != 4 {
+		t.Errorf("With the seen cache %d skipped, %d CheckDig(s) sent", skipped, cached)
+	}
+}
@@ -0,0 +1,118 @@
+package griptests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wyathan/grip"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//stressNetwork runs num nodes on a test network where failpct
+//percent of reads and sends fail, and checks nothing gets stuck.
+//Close the SOCKETS when done.
+func stressNetwork(t *testing.T, num int, failpct int, timeout time.Duration) ([]*gripdata.Node, []*TestDB) {
+	clearTestGlobals()
+	tn := InitTestNetwork()
+	tn.FailPercent = failpct
+	var nodes []*gripdata.Node
+	var pnodes []*gripdata.MyNodePrivateData
+	var dbs []*TestDB
+	for c := 0; c < num; c++ {
+		pr, n, db := createNewNode(c, c == 0, tn)
+		nodes = append(nodes, n)
+		pnodes = append(pnodes, pr)
+		dbs = append(dbs, db)
+	}
+	associateWithNodeZero(nodes, pnodes, dbs)
+	if !WaitUntilSentWithin(nodes, dbs, timeout) {
+		t.Fatalf("Associate node keys stuck with %d%% failures", failpct)
+	}
+
+	var shr gripdata.ShareNodeInfo
+	shr.Key = "stresskey"
+	shr.NodeID = nodes[1].ID
+	shr.TargetNodeID = nodes[0].ID
+	err := grip.NewShareNode(&shr, dbs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitUntilSentWithin(nodes, dbs, timeout) {
+		t.Fatalf("ShareNodeInfo stuck with %d%% failures", failpct)
+	}
+	return nodes, dbs
+}
+
+func closeStressNetwork() {
+	for _, s := range SOCKETS {
+		s.Close()
+	}
+}
+
+func TestStressNoFailures(t *testing.T) {
+	defer closeStressNetwork()
+	num := 10
+	nodes, dbs := stressNetwork(t, num, 0, time.Minute)
+	for c := 2; c < num; c++ {
+		var ks gripdata.UseShareNodeKey
+		ks.Key = "stresskey"
+		ks.TargetID = nodes[0].ID
+		err := grip.NewUseShareNodeKey(&ks, dbs[c])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	allknown := func() bool {
+		for c := 1; c < num; c++ {
+			if num != len(dbs[c].ListNodes()) {
+				return false
+			}
+		}
+		return true
+	}
+	if !WaitFor(allknown, time.Minute) {
+		for c := 1; c < num; c++ {
+			t.Errorf("Node %d knows %d nodes", c, len(dbs[c].ListNodes()))
+		}
+		t.Fatal("Nodes not shared")
+	}
+}
+
+func TestStressHighFailures(t *testing.T) {
+	defer closeStressNetwork()
+	stressNetwork(t, 10, 10, 3*time.Minute)
+}
+
+//TestSendQueueWait checks a full queue holds the sender until the
+//write routine makes room, and only gives up after the timeout
+func TestSendQueueWait(t *testing.T) {
+	q := grip.NewSendQueue(1)
+	if err := q.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(2); err != griperrors.SendQueueFull {
+		t.Errorf("Push to a full queue: %v", err)
+	}
+	if err := q.PushWait(2, 50*time.Millisecond); err != griperrors.SendQueueFull {
+		t.Errorf("PushWait did not time out: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Pop()
+	}()
+	if err := q.PushWait(2, time.Minute); err != nil {
+		t.Errorf("PushWait did not get the room: %v", err)
+	}
+	if d, ok := q.Pop(); !ok || d != 2 {
+		t.Errorf("Wrong message queued: %v", d)
+	}
+	q.Push(3)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Close()
+	}()
+	if err := q.PushWait(4, time.Minute); err != griperrors.ConnectionClosed {
+		t.Errorf("PushWait on a closed queue: %v", err)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	IncrNumberContexts(a *gripdata.Account) error
 	IncrNumberNodes(a *gripdata.Account) error
 	CheckUpdateStorageUsed(a *gripdata.Account, fsize uint64) error
+	CheckUpdateRelayUsed(a *gripdata.Account, n uint64) error
 */
 
 func (t *TestDB) StoreAccount(a *gripdata.Account) error {
@@ -98,6 +99,17 @@ func (t *TestDB) FreeStorageUsed(a *gripdata.Account, fsize uint64) (*gripdata.A
 	t.Accounts[a.AccountID] = a
 	return a, nil
 }
+func (t *TestDB) CheckUpdateRelayUsed(a *gripdata.Account, n uint64) error {
+	t.Lock()
+	defer t.Unlock()
+	a = t.Accounts[a.AccountID]
+	if a.RelayBytesUsed+n > a.MaxRelayBytes {
+		return fmt.Errorf("would exceed max relay bytes %d > %d", a.RelayBytesUsed+n, a.MaxRelayBytes)
+	}
+	a.RelayBytesUsed = a.RelayBytesUsed + n
+	t.Accounts[a.AccountID] = a
+	return nil
+}
 func (t *TestDB) SetAccountMessage(a *gripdata.Account, msg string) error {
 	t.Lock()
 	defer t.Unlock()
@@ -100,11 +100,11 @@ func (t *TestDB) GetContextResponses(cid []byte) []*gripdata.ContextResponse {
 	defer t.Unlock()
 	sid := base64.StdEncoding.EncodeToString(cid)
 	rm := t.ContextResponses[sid]
-	var r []gripdata.ContextResponse
+	var r []*gripdata.ContextResponse
 	for _, v := range rm {
-		r = append(r, *v)
+		r = append(r, v)
 	}
-	return nil
+	return r
 }
 func (t *TestDB) StoreContextFile(cf *gripdata.ContextFile) (*gripdata.ContextFileWrap, error) {
 	t.Lock()
@@ -293,6 +293,42 @@ func (t *TestDB) GetContextFileDeleted(dig []byte) *gripdata.DeletedContextFile
 	scid := base64.StdEncoding.EncodeToString(dig)
 	return t.DeletedFiles[scid]
 }
+func (t *TestDB) GetNodeContexts(id []byte) [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	var r [][]byte
+	for k, c := range t.Contexts {
+		mbr := bytes.Equal(c.NodeID, id)
+		for _, cr := range t.ContextRequests[k] {
+			mbr = mbr || bytes.Equal(cr.TargetNodeID, id)
+		}
+		if mbr {
+			r = append(r, c.Dig)
+		}
+	}
+	return r
+}
+func (t *TestDB) GetContextFiles(cid []byte) []*gripdata.ContextFileWrap {
+	t.Lock()
+	defer t.Unlock()
+	var r []*gripdata.ContextFileWrap
+	for _, f := range t.ContextFiles[base64.StdEncoding.EncodeToString(cid)] {
+		v := f
+		r = append(r, &v)
+	}
+	return r
+}
+func (t *TestDB) GetContextFilesDeleted(cid []byte) []*gripdata.DeletedContextFile {
+	t.Lock()
+	defer t.Unlock()
+	var r []*gripdata.DeletedContextFile
+	for _, d := range t.DeletedFiles {
+		if bytes.Equal(d.Context, cid) {
+			r = append(r, d)
+		}
+	}
+	return r
+}
 func (t *TestDB) GetNodeContextPairs(id []byte) map[string]*gripdata.ContextPairWrap {
 	return nil
 }
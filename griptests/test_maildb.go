@@ -0,0 +1,125 @@
+package griptests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"sort"
+
+	"github.com/wyathan/grip/gripdata"
+)
+
+/*
+	StoreMail(m *gripdata.Mail) error
+	GetMail(to []byte, dig []byte) *gripdata.Mail
+	ListMail(to []byte, max int) []gripdata.Mail
+	SetMailDelivered(to []byte, dig []byte, msg string, code int) (*gripdata.Mail, error)
+	ListMailDelivered(from []byte, max int) []gripdata.Mail
+	DeleteMail(to []byte, dig []byte) error
+	StoreMailDeposited(d *gripdata.MailDeposited) error
+	GetMailDeposited(mailbox []byte, to []byte, dig []byte) *gripdata.MailDeposited
+	DeleteMailDeposited(mailbox []byte, to []byte, dig []byte) error
+*/
+
+func mailKey(to []byte, dig []byte) string {
+	return base64.StdEncoding.EncodeToString(to) + ":" + base64.StdEncoding.EncodeToString(dig)
+}
+
+func (t *TestDB) StoreMail(m *gripdata.Mail) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.Mail == nil {
+		t.Mail = make(map[string]*gripdata.Mail)
+	}
+	k := mailKey(m.To, m.Dig)
+	if t.Mail[k] != nil {
+		return errors.New("Mail already stored")
+	}
+	nm := *m
+	t.Mail[k] = &nm
+	return nil
+}
+func (t *TestDB) GetMail(to []byte, dig []byte) *gripdata.Mail {
+	t.Lock()
+	defer t.Unlock()
+	m := t.Mail[mailKey(to, dig)]
+	if m == nil {
+		return nil
+	}
+	r := *m
+	return &r
+}
+func (t *TestDB) listMail(max int, f func(m *gripdata.Mail) bool) []gripdata.Mail {
+	t.Lock()
+	defer t.Unlock()
+	var r []gripdata.Mail
+	for _, m := range t.Mail {
+		if f(m) {
+			r = append(r, *m)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Timestamp < r[j].Timestamp
+	})
+	if len(r) > max {
+		r = r[:max]
+	}
+	return r
+}
+func (t *TestDB) ListMail(to []byte, max int) []gripdata.Mail {
+	return t.listMail(max, func(m *gripdata.Mail) bool {
+		return !m.Delivered && bytes.Equal(m.To, to)
+	})
+}
+func (t *TestDB) SetMailDelivered(to []byte, dig []byte, msg string, code int) (*gripdata.Mail, error) {
+	t.Lock()
+	defer t.Unlock()
+	m := t.Mail[mailKey(to, dig)]
+	if m == nil || m.Delivered {
+		return nil, nil
+	}
+	m.Delivered = true
+	m.Message = msg
+	m.Code = code
+	m.Data = nil
+	r := *m
+	return &r, nil
+}
+func (t *TestDB) ListMailDelivered(from []byte, max int) []gripdata.Mail {
+	return t.listMail(max, func(m *gripdata.Mail) bool {
+		return m.Delivered && bytes.Equal(m.From, from)
+	})
+}
+func (t *TestDB) DeleteMail(to []byte, dig []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.Mail, mailKey(to, dig))
+	return nil
+}
+
+func (t *TestDB) StoreMailDeposited(d *gripdata.MailDeposited) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.MailDeposits == nil {
+		t.MailDeposits = make(map[string]*gripdata.MailDeposited)
+	}
+	nd := *d
+	t.MailDeposits[base64.StdEncoding.EncodeToString(d.Mailbox)+":"+mailKey(d.To, d.Dig)] = &nd
+	return nil
+}
+func (t *TestDB) GetMailDeposited(mailbox []byte, to []byte, dig []byte) *gripdata.MailDeposited {
+	t.Lock()
+	defer t.Unlock()
+	d := t.MailDeposits[base64.StdEncoding.EncodeToString(mailbox)+":"+mailKey(to, dig)]
+	if d == nil {
+		return nil
+	}
+	r := *d
+	return &r
+}
+func (t *TestDB) DeleteMailDeposited(mailbox []byte, to []byte, dig []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.MailDeposits, base64.StdEncoding.EncodeToString(mailbox)+":"+mailKey(to, dig))
+	return nil
+}
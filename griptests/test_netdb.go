@@ -12,20 +12,27 @@ import (
 /*
 	StoreSendData(s *gripdata.SendData) error
 	StoreRejectedSendData(s *gripdata.RejectedSendData) error
+	ListRejectedSendData(target []byte, typename string) []gripdata.RejectedSendData
+	DeleteRejectedSendData(d []byte, target []byte) error
 	GetSendData(target []byte, max int) []gripdata.SendData //get all send data for target node
 	DeleteSendData(d []byte, to []byte) (bool, error) //Data has been setnt to the node
 	GetDigestData(d []byte) interface{}
 	GetConnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera
+	GetUnconnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera
 	GetConnectableNodesWithShareNodeKey(max int, curtime uint64) []gripdata.NodeEphemera
 	GetConnectableUseShareKeyNodes(max int, curtime uint64) []gripdata.NodeEphemera
 	GetConnectableAny(max int, curtime uint64) []gripdata.NodeEphemera
 	GetAllConnected() []gripdata.NodeEphemera
 	CreateNodeEphemera(id []byte, connectable bool) error
 	SetNodeEphemeraNextConnection(id []byte, last uint64, next uint64) error
+	SetNodeEphemeraFailed(id []byte, last uint64, next uint64) error
 	ClearAllConnected()
 	CanNodeEphemeraGoPending(id []byte) bool
 	SetNodeEphemeraConnected(incomming bool, id []byte, curtime uint64) error
 	SetNodeEphemeraClosed(id []byte) error
+	StoreSeenDig(s *gripdata.SeenDig) error
+	ListSeenDigs(max int) []gripdata.SeenDig
+	DeleteSeenDig(dig []byte, node []byte) error
 */
 
 func (t *TestDB) StoreSendData(s *gripdata.SendData) error {
@@ -36,6 +43,11 @@ func (t *TestDB) StoreSendData(s *gripdata.SendData) error {
 	}
 	tk := base64.StdEncoding.EncodeToString(s.TargetID)
 	kl := t.SendData[tk]
+	for _, v := range kl {
+		if bytes.Equal(v.Dig, s.Dig) {
+			return nil //Already waiting to go
+		}
+	}
 	t.SendData[tk] = append(kl, *s) //convenient all send data will already be sorted
 	return nil
 }
@@ -47,6 +59,35 @@ func (t *TestDB) StoreRejectedSendData(s *gripdata.RejectedSendData) error {
 	t.RejectedData[nid] = append(r, *s)
 	return nil
 }
+func (t *TestDB) ListRejectedSendData(target []byte, typename string) []gripdata.RejectedSendData {
+	t.Lock()
+	defer t.Unlock()
+	var r []gripdata.RejectedSendData
+	for k, rl := range t.RejectedData {
+		if target != nil && k != base64.StdEncoding.EncodeToString(target) {
+			continue
+		}
+		for _, v := range rl {
+			if typename == "" || v.TypeName == typename {
+				r = append(r, v)
+			}
+		}
+	}
+	return r
+}
+func (t *TestDB) DeleteRejectedSendData(d []byte, target []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	nid := base64.StdEncoding.EncodeToString(target)
+	var nl []gripdata.RejectedSendData
+	for _, v := range t.RejectedData[nid] {
+		if !bytes.Equal(v.Dig, d) {
+			nl = append(nl, v)
+		}
+	}
+	t.RejectedData[nid] = nl
+	return nil
+}
 func (t *TestDB) GetSendData(target []byte, max int) []gripdata.SendData {
 	t.Lock()
 	defer t.Unlock()
@@ -103,6 +144,20 @@ func (t *TestDB) GetConnectableNodesWithSendData(max int, curtime uint64) []grip
 	}
 	return r
 }
+func (t *TestDB) GetUnconnectableNodesWithSendData(max int, curtime uint64) []gripdata.NodeEphemera {
+	t.Lock()
+	defer t.Unlock()
+	var r []gripdata.NodeEphemera
+	for _, v := range t.NodeEphemera {
+		tk := base64.StdEncoding.EncodeToString(v.ID)
+		if !v.Connected && len(r) < max && v.NextAttempt <= curtime && !v.Connectable {
+			if len(t.SendData[tk]) > 0 {
+				r = append(r, *v)
+			}
+		}
+	}
+	return r
+}
 func (t *TestDB) GetConnectableNodesWithShareNodeKey(max int, curtime uint64) []gripdata.NodeEphemera {
 	t.Lock()
 	defer t.Unlock()
@@ -212,6 +267,28 @@ func (t *TestDB) SetNodeEphemeraNextConnection(id []byte, last uint64, next uint
 	}
 	return nil
 }
+func (t *TestDB) SetNodeEphemeraFailed(id []byte, last uint64, next uint64) error {
+	t.Lock()
+	defer t.Unlock()
+	tk := base64.StdEncoding.EncodeToString(id)
+	ep := t.NodeEphemera[tk]
+	if ep != nil {
+		ep.ConnFailures++
+		ep.LastConnAttempt = last
+		ep.NextAttempt = next
+		ep.ConnectionPending = false
+	}
+	return nil
+}
+func (t *TestDB) SetNodeEphemeraAddress(id []byte, url string) error {
+	t.Lock()
+	defer t.Unlock()
+	ep := t.NodeEphemera[base64.StdEncoding.EncodeToString(id)]
+	if ep != nil {
+		ep.LastAddress = url
+	}
+	return nil
+}
 func (t *TestDB) ClearAllConnected() {
 	t.Lock()
 	defer t.Unlock()
@@ -249,6 +326,7 @@ func (t *TestDB) SetNodeEphemeraConnected(incomming bool, id []byte, curtime uin
 	}
 	nid.Connected = true
 	nid.ConnectionPending = false
+	nid.ConnFailures = 0
 	if incomming {
 		nid.LastConnReceived = curtime
 	} else {
@@ -267,3 +345,50 @@ func (t *TestDB) SetNodeEphemeraClosed(id []byte) error {
 	}
 	return nil
 }
+
+//NumSendDataTo is the number of SendData waiting to be sent to id
+func (t *TestDB) NumSendDataTo(id []byte) int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.SendData[base64.StdEncoding.EncodeToString(id)])
+}
+
+//GetNodeEphemera a copy of the NodeEphemera for id
+func (t *TestDB) GetNodeEphemera(id []byte) *gripdata.NodeEphemera {
+	t.Lock()
+	defer t.Unlock()
+	ep := t.NodeEphemera[base64.StdEncoding.EncodeToString(id)]
+	if ep == nil {
+		return nil
+	}
+	c := *ep
+	return &c
+}
+
+func (t *TestDB) StoreSeenDig(s *gripdata.SeenDig) error {
+	t.Lock()
+	defer t.Unlock()
+	t.SeenDigs = append(t.SeenDigs, *s)
+	return nil
+}
+func (t *TestDB) ListSeenDigs(max int) []gripdata.SeenDig {
+	t.Lock()
+	defer t.Unlock()
+	r := t.SeenDigs
+	if len(r) > max {
+		r = r[len(r)-max:]
+	}
+	return append([]gripdata.SeenDig(nil), r...)
+}
+func (t *TestDB) DeleteSeenDig(dig []byte, node []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	var nl []gripdata.SeenDig
+	for _, s := range t.SeenDigs {
+		if !bytes.Equal(s.Dig, dig) || (node != nil && !bytes.Equal(s.NodeID, node)) {
+			nl = append(nl, s)
+		}
+	}
+	t.SeenDigs = nl
+	return nil
+}
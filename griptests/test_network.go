@@ -1,23 +1,26 @@
 package griptests
 
 import (
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"log"
 	"math/rand"
+	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/wyathan/grip"
 	"github.com/wyathan/grip/gripdata"
 )
 
-//NETWORKFAILPERCENT is the likelyhood a network transaction will fail
+//NETWORKFAILPERCENT is the default likelyhood a network transaction will fail
 const NETWORKFAILPERCENT = 5
 
 func (t *TestConnection) isFail() bool {
 	v := rand.Intn(100)
-	fl := v < NETWORKFAILPERCENT
+	fl := v < t.Network.FailPercent
 	if fl {
 		log.Printf("RANDOM FAILURE FROM %d to %d value: %d\n", t.LclIndex, t.RmtIndex, v)
 		go func() {
@@ -45,12 +48,49 @@ func testTestConnectionImplements() {
 func InitTestNetwork() *TestNetwork {
 	var n TestNetwork
 	n.testsockets = make(map[string]*TestSocket)
+	n.messages = make(map[string]int)
+	n.FailPercent = NETWORKFAILPERCENT
 	return &n
 }
 
 type TestNetwork struct {
 	sync.Mutex
 	testsockets map[string]*TestSocket
+	fileBytes   uint64
+	wireBytes   uint64
+	messages    map[string]int
+	FailPercent int       //Set before any nodes connect
+	DialGate    chan bool //If set ConnectTo waits until it is closed
+	dialing     int32
+	Setup       func(s *grip.SocketController) //Called before each node starts
+}
+
+//Dialing the number of ConnectTo calls waiting on the DialGate
+func (n *TestNetwork) Dialing() int {
+	return int(atomic.LoadInt32(&n.dialing))
+}
+
+//FileBytes the number of bytes of file data delivered
+func (n *TestNetwork) FileBytes() uint64 {
+	return atomic.LoadUint64(&n.fileBytes)
+}
+
+//WireBytes the number of bytes sent, as they would be encoded
+func (n *TestNetwork) WireBytes() uint64 {
+	return atomic.LoadUint64(&n.wireBytes)
+}
+
+//Messages the number of messages sent with the wire type name
+func (n *TestNetwork) Messages(name string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.messages[name]
+}
+
+func (n *TestNetwork) countMessage(d interface{}) {
+	n.Lock()
+	n.messages[grip.WireTypeName(d)]++
+	n.Unlock()
 }
 
 func (n *TestNetwork) getAllSockets() []*TestSocket {
@@ -134,17 +174,25 @@ func (s *TestSocket) ConnectTo(n *gripdata.Node) (grip.Connection, error) {
 	t.ID = n.ID
 	t.LclIndex = s.Index
 	t.RmtIndex = ts.Index
+	t.Network = s.Network
 	fv := rand.Intn(100)
-	if fv < NETWORKFAILPERCENT {
+	if fv < s.Network.FailPercent {
 		log.Printf("RANDOM FAILURE FROM %d to %d value: %d", t.LclIndex, t.RmtIndex, fv)
 		return nil, errors.New("Random connection failure")
 	}
 
+	if s.Network.DialGate != nil {
+		atomic.AddInt32(&s.Network.dialing, 1)
+		<-s.Network.DialGate
+		atomic.AddInt32(&s.Network.dialing, -1)
+	}
+
 	tr.ReadC = t.WriteC
 	tr.WriteC = t.ReadC
 	tr.ID = s.ID
 	tr.LclIndex = ts.Index
 	tr.RmtIndex = s.Index
+	tr.Network = s.Network
 
 	ts.SC <- &tr
 
@@ -160,6 +208,7 @@ type TestConnection struct {
 	WriteC   chan interface{}
 	ReadC    chan interface{}
 	Closed   bool
+	Network  *TestNetwork
 }
 
 func (c *TestConnection) Read() (interface{}, error) {
@@ -170,6 +219,9 @@ func (c *TestConnection) Read() (interface{}, error) {
 	if c.isFail() {
 		return nil, errors.New("Random connection failure")
 	}
+	if fc, ok := r.(grip.FileChunk); ok {
+		atomic.AddUint64(&c.Network.fileBytes, uint64(len(fc.Data)))
+	}
 	log.Printf("READ FROM: %d TO: %d %s\n", c.RmtIndex, c.LclIndex, reflect.TypeOf(r).String())
 	return r, nil
 }
@@ -182,6 +234,10 @@ func (c *TestConnection) Send(d interface{}) error {
 		return errors.New("Connection closed")
 	}
 	c.WriteC <- d
+	if b, err := grip.EncodeMessage(d); err == nil {
+		atomic.AddUint64(&c.Network.wireBytes, uint64(len(b)))
+	}
+	c.Network.countMessage(d)
 	switch v := d.(type) {
 	default:
 		log.Printf("SEND FROM %d TO: %d %s\n", c.LclIndex, c.RmtIndex, reflect.TypeOf(d).String())
@@ -213,3 +269,43 @@ func (c *TestConnection) Close() {
 func (c *TestConnection) GetNodeID() []byte {
 	return c.ID
 }
+
+//TapConn records every byte that crosses a stream connection,
+//like an eavesdropper on the wire would see them
+type TapConn struct {
+	net.Conn
+	sync.Mutex
+	seen bytes.Buffer
+}
+
+//NewTapConn taps c
+func NewTapConn(c net.Conn) *TapConn {
+	var t TapConn
+	t.Conn = c
+	return &t
+}
+
+func (t *TapConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.record(b[:n])
+	return n, err
+}
+
+func (t *TapConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.record(b[:n])
+	return n, err
+}
+
+func (t *TapConn) record(b []byte) {
+	t.Lock()
+	defer t.Unlock()
+	t.seen.Write(b)
+}
+
+//Seen everything that crossed the wire so far
+func (t *TapConn) Seen() []byte {
+	t.Lock()
+	defer t.Unlock()
+	return append([]byte(nil), t.seen.Bytes()...)
+}
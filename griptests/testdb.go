@@ -35,6 +35,9 @@ type TestDB struct {
 	FileTransfers        map[string][]*gripdata.ContextFileTransferWrap
 	DeletedFiles         map[string]*gripdata.DeletedContextFile
 	VeryBadContextFiles  []gripdata.ContextFile
+	Mail                 map[string]*gripdata.Mail
+	MailDeposits         map[string]*gripdata.MailDeposited
+	SeenDigs             []gripdata.SeenDig
 }
 
 func NewTestDB() *TestDB {
@@ -57,6 +60,8 @@ func NewTestDB() *TestDB {
 	t.ContextFiles = make(map[string][]gripdata.ContextFileWrap)
 	t.RejectedData = make(map[string][]gripdata.RejectedSendData)
 	t.ContextFilesByDepDig = make(map[string]*gripdata.ContextFileWrap)
+	t.Mail = make(map[string]*gripdata.Mail)
+	t.MailDeposits = make(map[string]*gripdata.MailDeposited)
 	return &t
 }
 
@@ -75,4 +80,7 @@ func testTestDBImplements() {
 	var s grip.DB
 	s = &t
 	s.GetAccount("")
+	var sn grip.Seendb
+	sn = &t
+	sn.ListSeenDigs(0)
 }
@@ -0,0 +1,217 @@
+package grip
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+)
+
+//NONCESIZE is the number of random bytes in a handshake challenge
+const NONCESIZE int = 32
+
+//HandshakeHello starts a handshake.  It carries our Node so the
+//other side can check the key behind the id we claim, a
+//challenge for the other side to sign, and the public half
+//of our session key.
+type HandshakeHello struct {
+	Node      *gripdata.Node
+	Nonce     []byte
+	Ephemeral []byte
+}
+
+//HandshakeProof proves a node owns the private key for its
+//Node by signing the other node's challenge.  Both session keys
+//are signed too, which binds the session to the two nodes.
+type HandshakeProof struct {
+	NodeID        []byte //The node proving who it is
+	PeerID        []byte //The node the proof is for
+	Nonce         []byte //The challenge sent by PeerID
+	PeerNonce     []byte //The challenge sent by NodeID
+	Ephemeral     []byte //The session key sent by NodeID
+	PeerEphemeral []byte //The session key sent by PeerID
+	Dig           []byte
+	Sig           []byte
+}
+
+//Digest HandshakeProof
+func (a *HandshakeProof) Digest() []byte {
+	h := sha512.New()
+	gripcrypto.HashString(h, "grip handshake")
+	gripcrypto.HashBytes(h, a.NodeID)
+	gripcrypto.HashBytes(h, a.PeerID)
+	gripcrypto.HashBytes(h, a.Nonce)
+	gripcrypto.HashBytes(h, a.PeerNonce)
+	gripcrypto.HashBytes(h, a.Ephemeral)
+	gripcrypto.HashBytes(h, a.PeerEphemeral)
+	a.Dig = h.Sum(nil)
+	return a.Dig
+}
+
+//SetSig HandshakeProof
+func (a *HandshakeProof) SetSig(b []byte) {
+	a.Sig = b
+}
+
+//GetSig HandshakeProof
+func (a *HandshakeProof) GetSig() []byte {
+	return a.Sig
+}
+
+//GetNodeID HandshakeProof
+func (a *HandshakeProof) GetNodeID() []byte {
+	return a.NodeID
+}
+
+//GetDig HandshakeProof
+func (a *HandshakeProof) GetDig() []byte {
+	return a.Dig
+}
+
+//SetNodeID HandshakeProof
+func (a *HandshakeProof) SetNodeID(id []byte) {
+	a.NodeID = id
+}
+
+//msgConn is anything we can run a handshake over
+type msgConn interface {
+	Read() (interface{}, error)
+	Send(d interface{}) error
+}
+
+//session is what a successful handshake gives us
+type session struct {
+	node *gripdata.Node
+	send *sessionCipher
+	recv *sessionCipher
+}
+
+//handshake proves to the other node that we own our node key, and
+//checks that it owns the key behind the id it claims.  The dialing
+//side always sends first so unbuffered streams do not deadlock.
+//If expect is not nil the other node must be that node.
+func handshake(c msgConn, dialer bool, expect []byte, db Nodedb) (*session, error) {
+	myn, pr := db.GetPrivateNodeData()
+	if myn == nil || pr == nil {
+		return nil, errors.New("Private node data not found")
+	}
+	sk, err := newSessionKey()
+	if err != nil {
+		return nil, err
+	}
+	var hello HandshakeHello
+	hello.Node = myn
+	hello.Ephemeral = sk.Public()
+	hello.Nonce = make([]byte, NONCESIZE)
+	_, err = rand.Read(hello.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	var peer *HandshakeHello
+	if dialer {
+		err = c.Send(hello)
+		if err == nil {
+			peer, err = readHello(c, expect)
+		}
+	} else {
+		peer, err = readHello(c, expect)
+		if err == nil {
+			err = c.Send(hello)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var proof HandshakeProof
+	proof.NodeID = myn.ID
+	proof.PeerID = peer.Node.ID
+	proof.Nonce = peer.Nonce
+	proof.PeerNonce = hello.Nonce
+	proof.Ephemeral = hello.Ephemeral
+	proof.PeerEphemeral = peer.Ephemeral
+	err = gripcrypto.Sign(&proof, pr.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if dialer {
+		err = c.Send(proof)
+		if err == nil {
+			err = readProof(c, peer, &hello)
+		}
+	} else {
+		err = readProof(c, peer, &hello)
+		if err == nil {
+			err = c.Send(proof)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ses session
+	ses.node = peer.Node
+	ses.send, ses.recv, err = sk.ciphers(peer.Ephemeral, transcript(dialer, &hello, peer), dialer)
+	if err != nil {
+		return nil, err
+	}
+	return &ses, nil
+}
+
+//transcript everything both sides saw in the hellos, in the
+//same order on both sides
+func transcript(dialer bool, mine *HandshakeHello, peer *HandshakeHello) []byte {
+	d, a := mine, peer
+	if !dialer {
+		d, a = peer, mine
+	}
+	h := sha512.New()
+	gripcrypto.HashBytes(h, d.Node.ID)
+	gripcrypto.HashBytes(h, a.Node.ID)
+	gripcrypto.HashBytes(h, d.Nonce)
+	gripcrypto.HashBytes(h, a.Nonce)
+	gripcrypto.HashBytes(h, d.Ephemeral)
+	gripcrypto.HashBytes(h, a.Ephemeral)
+	return h.Sum(nil)
+}
+
+func readHello(c msgConn, expect []byte) (*HandshakeHello, error) {
+	d, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+	h, ok := d.(HandshakeHello)
+	if !ok || h.Node == nil || len(h.Nonce) != NONCESIZE || h.Ephemeral == nil {
+		return nil, errors.New("Invalid handshake hello")
+	}
+	if expect != nil && !bytes.Equal(expect, h.Node.ID) {
+		return nil, errors.New("Connected to the wrong node")
+	}
+	//Make sure the id is the digest of the public key
+	_, err = VerifyNode(h.Node, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func readProof(c msgConn, peer *HandshakeHello, mine *HandshakeHello) error {
+	d, err := c.Read()
+	if err != nil {
+		return err
+	}
+	p, ok := d.(HandshakeProof)
+	if !ok {
+		return errors.New("Invalid handshake proof")
+	}
+	if !bytes.Equal(p.NodeID, peer.Node.ID) || !bytes.Equal(p.PeerID, mine.Node.ID) ||
+		!bytes.Equal(p.Nonce, mine.Nonce) || !bytes.Equal(p.PeerNonce, peer.Nonce) ||
+		!bytes.Equal(p.Ephemeral, peer.Ephemeral) || !bytes.Equal(p.PeerEphemeral, mine.Ephemeral) {
+		return errors.New("Handshake proof is not for this connection")
+	}
+	if !gripcrypto.Verify(&p, peer.Node.PublicKey) {
+		return errors.New("Node does not own its key")
+	}
+	return nil
+}
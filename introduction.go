@@ -0,0 +1,136 @@
+package grip
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//PROTOCOLVERSION is the newest protocol version this node speaks
+const PROTOCOLVERSION uint32 = 1
+
+//MINPROTOCOLVERSION is the oldest protocol version this node
+//still speaks
+const MINPROTOCOLVERSION uint32 = 1
+
+//INTRODUCTIONTIMEOUT is how long we wait for the other node's
+//Introduction before giving up on the connection
+const INTRODUCTIONTIMEOUT time.Duration = 10 * time.Second
+
+//INCOMPATIBLERETRY is how long we wait to connect again to a node
+//that does not speak any protocol version we do.  It is long
+//because nothing will change until one of the nodes is upgraded.
+const INCOMPATIBLERETRY time.Duration = 1 * time.Hour
+
+//CAPSIGECDSAP521 the node can verify ECDSA P-521 signatures
+const CAPSIGECDSAP521 string = "sig-ecdsa-p521"
+
+//Capabilities the optional features this node supports
+var Capabilities = []string{CAPSIGECDSAP521, CAPKEEPALIVE, CAPRELAY, CAPMAILBOX, CAPDEFLATE, CAPBATCHDIGS, CAPCONTEXTSYNC}
+
+//Introduction is the first message sent on every connection
+type Introduction struct {
+	Node         *gripdata.Node
+	Version      uint32
+	MinVersion   uint32
+	Capabilities []string
+}
+
+//NewIntroduction the Introduction this node sends
+func NewIntroduction(n *gripdata.Node) Introduction {
+	var i Introduction
+	i.Node = n
+	i.Version = PROTOCOLVERSION
+	i.MinVersion = MINPROTOCOLVERSION
+	i.Capabilities = Capabilities
+	return i
+}
+
+//NegotiateIntroduction finds the protocol version and features
+//both nodes can use.  The newest version both speak is used, and
+//only capabilities both nodes list are enabled.
+func NegotiateIntroduction(mine Introduction, peer Introduction) (uint32, map[string]bool, error) {
+	v := mine.Version
+	if peer.Version < v {
+		v = peer.Version
+	}
+	if v < mine.MinVersion || v < peer.MinVersion {
+		return 0, nil, griperrors.IncompatibleVersion
+	}
+	have := make(map[string]bool)
+	for _, c := range mine.Capabilities {
+		have[c] = true
+	}
+	f := make(map[string]bool)
+	for _, c := range peer.Capabilities {
+		if have[c] {
+			f[c] = true
+		}
+	}
+	return v, f, nil
+}
+
+//HasFeature true if both nodes on this connection support c.
+//Only valid once the introductions have been exchanged.
+func (ctrl *ConnectionController) HasFeature(c string) bool {
+	return ctrl.Features[c]
+}
+
+func (ctrl *ConnectionController) sendIntroduction() {
+	myn, _ := ctrl.DB.GetPrivateNodeData()
+	err := ctrl.C.Send(NewIntroduction(myn))
+	if err != nil {
+		log.Print("Failed to send my node data for connection init")
+		ctrl.Close()
+	}
+}
+
+//endIntroduction lets the write routine go on.  It is called
+//when the Introduction is read, and when the read routine exits
+//so the write routine is never left waiting.
+func (ctrl *ConnectionController) endIntroduction() {
+	ctrl.introOnce.Do(func() {
+		close(ctrl.Introduced)
+	})
+}
+
+//waitForIntroduction true if we can start sending data
+func (ctrl *ConnectionController) waitForIntroduction() bool {
+	select {
+	case <-ctrl.Introduced:
+	case <-ctrl.Queue.Done():
+		return false
+	case <-time.After(INTRODUCTIONTIMEOUT):
+		log.Print("Node did not introduce itself in time")
+		ctrl.Close()
+		return false
+	}
+	return ctrl.Features != nil && !ctrl.IsDone()
+}
+
+func (ctrl *ConnectionController) readIntroduction(d interface{}) error {
+	v, ok := d.(Introduction)
+	if !ok || v.Node == nil {
+		return griperrors.NoIntroduction
+	}
+	if !bytes.Equal(v.Node.ID, ctrl.C.GetNodeID()) {
+		return griperrors.NoIntroduction
+	}
+	myn, _ := ctrl.DB.GetPrivateNodeData()
+	ver, f, err := NegotiateIntroduction(NewIntroduction(myn), v)
+	if err != nil {
+		log.Printf("Node speaks protocol %d to %d, we speak %d to %d", v.MinVersion, v.Version, MINPROTOCOLVERSION, PROTOCOLVERSION)
+		nt := uint64(time.Now().UnixNano())
+		ctrl.DB.SetNodeEphemeraNextConnection(ctrl.C.GetNodeID(), nt, nt+uint64(INCOMPATIBLERETRY.Nanoseconds()))
+		return err
+	}
+	ctrl.PeerVersion = ver
+	ctrl.Features = f
+	err = IncomingNode(v.Node, ctrl.DB)
+	ctrl.processSendError("Node", v.Node.Dig, err)
+	ctrl.endIntroduction()
+	return nil
+}
@@ -0,0 +1,98 @@
+package grip
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+//PINGINTERVAL is how long we wait to hear from a node before we
+//ping it
+const PINGINTERVAL time.Duration = 5 * time.Second
+
+//PEERTIMEOUT is how long a node may be silent before we decide
+//it is gone and close the connection
+const PEERTIMEOUT time.Duration = 30 * time.Second
+
+//SUPERVISEINTERVAL is how often the supervisor checks the
+//connections
+const SUPERVISEINTERVAL time.Duration = 1 * time.Second
+
+//CAPKEEPALIVE the node answers Pings.  Only nodes that do are
+//closed for being silent, the others may just have nothing to say.
+const CAPKEEPALIVE string = "keepalive"
+
+//Ping asks the other node to show it is still there
+type Ping struct {
+	Nonce uint64
+}
+
+//Pong answers a Ping
+type Pong struct {
+	Nonce uint64
+}
+
+func since(t uint64) time.Duration {
+	return time.Duration(uint64(time.Now().UnixNano()) - t)
+}
+
+func (ctrl *ConnectionController) readLoopDone() {
+	atomic.StoreUint64(&ctrl.LastReadLoop, uint64(time.Now().UnixNano()))
+}
+
+func (ctrl *ConnectionController) writeLoopDone() {
+	atomic.StoreUint64(&ctrl.LastWriteLoop, uint64(time.Now().UnixNano()))
+}
+
+//keepAlive pings the other node if we have not heard from it
+//for the ping interval
+func (ctrl *ConnectionController) keepAlive() error {
+	if !ctrl.HasFeature(CAPKEEPALIVE) || ctrl.SocketCtrl == nil {
+		return nil
+	}
+	iv := ctrl.SocketCtrl.PingInterval
+	if since(atomic.LoadUint64(&ctrl.LastReadLoop)) < iv || time.Since(ctrl.lastPing) < iv {
+		return nil
+	}
+	ctrl.lastPing = time.Now()
+	return ctrl.C.Send(Ping{Nonce: uint64(ctrl.lastPing.UnixNano())})
+}
+
+//supervise closes the connection if the other node has been
+//silent too long, and flags routines that stopped looping.  The
+//read routine is only stuck if it is not waiting on the other node.
+func (ctrl *ConnectionController) supervise(timeout time.Duration) {
+	select {
+	case <-ctrl.Introduced:
+	default:
+		//The introduction has its own timeout
+		return
+	}
+	if ctrl.IsDone() || ctrl.Features == nil {
+		return
+	}
+	if since(atomic.LoadUint64(&ctrl.LastReadLoop)) > timeout {
+		if atomic.LoadInt32(&ctrl.reading) == 0 {
+			log.Printf("ERROR: Read routine stuck: %d", ctrl.ConID)
+		} else if ctrl.HasFeature(CAPKEEPALIVE) {
+			log.Printf("Node silent too long, closing connection: %d", ctrl.ConID)
+			ctrl.Close()
+		}
+	}
+	if since(atomic.LoadUint64(&ctrl.LastWriteLoop)) > timeout {
+		log.Printf("ERROR: Write routine stuck: %d", ctrl.ConID)
+	}
+}
+
+//superviseRoutine watches every connection.  It also flags the
+//connect routine if it stops looping.
+func (s *SocketController) superviseRoutine() {
+	for s.sleep(SUPERVISEINTERVAL) {
+		for _, c := range s.listConnections() {
+			c.supervise(s.PeerTimeout)
+		}
+		if since(atomic.LoadUint64(&s.LastLoop)) > s.PeerTimeout {
+			log.Printf("ERROR: Connect routine stuck")
+		}
+	}
+}
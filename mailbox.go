@@ -0,0 +1,375 @@
+package grip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"time"
+
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//CAPMAILBOX the node understands the mail messages.  It can leave
+//records with a mailbox, collect its own, and be a mailbox for any
+//node it has an Account for.
+const CAPMAILBOX string = "mailbox"
+
+//MAILINTERVAL how often we offer a connected node the data we
+//have for nodes that are offline
+const MAILINTERVAL time.Duration = 10 * time.Second
+
+//MailOffer asks if the node will hold Dig for To
+type MailOffer struct {
+	To  []byte
+	Dig []byte
+}
+
+//MailResp answers a MailOffer.  It also refuses a MailDeposit
+//that could not be stored.
+type MailResp struct {
+	To     []byte
+	Dig    []byte
+	Accept bool
+	HaveIt bool
+}
+
+//MailDeposit leaves an encoded record with a mailbox
+type MailDeposit struct {
+	To   []byte
+	Dig  []byte
+	Data []byte
+}
+
+//MailItem is a record a mailbox held for us
+type MailItem struct {
+	From []byte
+	Dig  []byte
+	Data []byte
+}
+
+//MailAck the record in a MailItem was processed.  Message is set
+//if it was rejected.  Either way it is not sent again.
+type MailAck struct {
+	Dig     []byte
+	Message string
+	Code    int //griperrors code for why, zero if it has none
+}
+
+//MailReceipt tells the node that left a record that it was
+//delivered, so it can drop its SendData
+type MailReceipt struct {
+	To      []byte
+	Dig     []byte
+	Message string //Why the To node rejected it
+	Code    int    //griperrors code for why, zero if it has none
+}
+
+//mailAnswer is a MailResp for the write routine to act on
+type mailAnswer MailResp
+
+//mailState what the write routine has done with mail on
+//this connection
+type mailState struct {
+	last    time.Time
+	offered map[string]bool //Records offered to the other node
+	sent    map[string]bool //MailItems not yet acknowledged
+	refused map[string]bool //Nodes the other node will not hold mail for
+}
+
+//newMailState nothing is offered until the connection has been
+//up for MAILINTERVAL, the node may have just come back online
+func newMailState() mailState {
+	var m mailState
+	m.last = time.Now()
+	m.offered = make(map[string]bool)
+	m.sent = make(map[string]bool)
+	m.refused = make(map[string]bool)
+	return m
+}
+
+func mailKey(to []byte, dig []byte) string {
+	return base64.StdEncoding.EncodeToString(to) + ":" + base64.StdEncoding.EncodeToString(dig)
+}
+
+//sendMail runs on the write routine.  As a mailbox it delivers
+//what the other node has waiting, and tells it what was delivered
+//for it.  As a sender it offers the other node what we have for
+//nodes that are offline.
+func (ctrl *ConnectionController) sendMail() (int, error) {
+	if !ctrl.HasFeature(CAPMAILBOX) {
+		return 0, nil
+	}
+	id := ctrl.C.GetNodeID()
+	n := 0
+	for _, m := range ctrl.DB.ListMail(id, MAXSEND) {
+		k := base64.StdEncoding.EncodeToString(m.Dig)
+		if !ctrl.mail.sent[k] {
+			err := ctrl.sendCounted(MailItem{From: m.From, Dig: m.Dig, Data: m.Data})
+			if err != nil {
+				return n, err
+			}
+			ctrl.mail.sent[k] = true
+			n++
+		}
+	}
+	for _, m := range ctrl.DB.ListMailDelivered(id, MAXSEND) {
+		err := ctrl.sendCounted(MailReceipt{To: m.To, Dig: m.Dig, Message: m.Message, Code: m.Code})
+		if err != nil {
+			return n, err
+		}
+		err = ctrl.DB.DeleteMail(m.To, m.Dig)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if time.Since(ctrl.mail.last) < MAILINTERVAL {
+		return n, nil
+	}
+	ctrl.mail.last = time.Now()
+	return n, ctrl.offerMail()
+}
+
+//offerMail the records we have for nodes that are not connected.
+//ContextFiles are not offered, a mailbox does not hold file data.
+func (ctrl *ConnectionController) offerMail() error {
+	id := ctrl.C.GetNodeID()
+	all := ^uint64(0)
+	el := ctrl.DB.GetConnectableNodesWithSendData(MAXSEND, all)
+	el = append(el, ctrl.DB.GetUnconnectableNodesWithSendData(MAXSEND, all)...)
+	cf := WireTypeName((*gripdata.ContextFile)(nil))
+	for _, e := range el {
+		if bytes.Equal(e.ID, id) || ctrl.mail.refused[base64.StdEncoding.EncodeToString(e.ID)] {
+			continue
+		}
+		for _, sd := range ctrl.DB.GetSendData(e.ID, MAXSEND) {
+			k := mailKey(e.ID, sd.Dig)
+			if sd.TypeName == cf || ctrl.mail.offered[k] {
+				continue
+			}
+			err := ctrl.sendCounted(MailOffer{To: e.ID, Dig: sd.Dig})
+			if err != nil {
+				return err
+			}
+			ctrl.mail.offered[k] = true
+		}
+	}
+	return nil
+}
+
+//mailAnswered runs on the write routine
+func (ctrl *ConnectionController) mailAnswered(v MailResp) error {
+	if !v.Accept {
+		ctrl.mail.refused[base64.StdEncoding.EncodeToString(v.To)] = true
+		//A refused MailDeposit is not held
+		return ctrl.DB.DeleteMailDeposited(ctrl.C.GetNodeID(), v.To, v.Dig)
+	}
+	if v.HaveIt {
+		return nil
+	}
+	d := ctrl.DB.GetDigestData(v.Dig)
+	if d == nil {
+		return nil
+	}
+	b, err := EncodeMessage(d)
+	if err != nil {
+		log.Printf("Failed to encode mail: %s", err)
+		return nil
+	}
+	err = ctrl.sendCounted(MailDeposit{To: v.To, Dig: v.Dig, Data: b})
+	if err != nil {
+		return err
+	}
+	var md gripdata.MailDeposited
+	md.Mailbox = ctrl.C.GetNodeID()
+	md.To = v.To
+	md.Dig = v.Dig
+	md.Timestamp = uint64(time.Now().UnixNano())
+	err = ctrl.DB.StoreMailDeposited(&md)
+	if err != nil {
+		log.Printf("Failed to store mail deposit: %s", err)
+	}
+	return nil
+}
+
+func (ctrl *ConnectionController) mailOffer(v MailOffer) {
+	var r MailResp
+	r.To = v.To
+	r.Dig = v.Dig
+	r.HaveIt = ctrl.DB.GetMail(v.To, v.Dig) != nil
+	r.Accept = r.HaveIt || IsIDAccountEnabled(v.To, ctrl.DB)
+	ctrl.queueSend(r)
+}
+
+func (ctrl *ConnectionController) mailDeposit(v MailDeposit) {
+	err := StoreMail(&v, ctrl.C.GetNodeID(), ctrl.DB)
+	if err != nil {
+		log.Printf("Mail refused: %s", err)
+		ctrl.queueSend(MailResp{To: v.To, Dig: v.Dig})
+	}
+}
+
+//mailTarget the node a record is addressed to, nil if it can be
+//sent to any node
+func mailTarget(d interface{}) []byte {
+	switch v := d.(type) {
+	case *gripdata.AssociateNodeAccountKey:
+		return v.TargetNodeID
+	case *gripdata.UseShareNodeKey:
+		return v.TargetID
+	case *gripdata.ContextRequest:
+		return v.TargetNodeID
+	}
+	return nil
+}
+
+//mailAllowed from has an Account with us, or shares nodes with to
+func mailAllowed(from []byte, to []byte, db DB) bool {
+	if IsIDAccountEnabled(from, db) {
+		return true
+	}
+	for _, id := range FindAllToShareWith(to, db) {
+		if bytes.Equal(id, from) {
+			return true
+		}
+	}
+	for _, id := range FindAllToShareWith(from, db) {
+		if bytes.Equal(id, to) {
+			return true
+		}
+	}
+	return false
+}
+
+//StoreMail holds a record left by from for the To node.  The
+//record must match its digest and be signed by a node we know.
+//The space is charged to the To node's Account.
+func StoreMail(v *MailDeposit, from []byte, db DB) error {
+	d, err := DecodeMessage(v.Data)
+	if err != nil {
+		return err
+	}
+	r, ok := d.(gripcrypto.SignInf)
+	if !ok || !bytes.Equal(r.GetDig(), v.Dig) || !bytes.Equal(r.Digest(), v.Dig) {
+		return griperrors.MailInvalid
+	}
+	if n, ok := d.(*gripdata.Node); ok {
+		_, err = VerifyNode(n, db)
+	} else {
+		_, err = VerifyNodeSig(r, db)
+	}
+	if err != nil {
+		return err
+	}
+	if t := mailTarget(d); t != nil && !bytes.Equal(t, v.To) {
+		return griperrors.MailWrongTarget
+	}
+	a := GetNodeAccount(v.To, db)
+	if a == nil || !a.Enabled {
+		return griperrors.MailNoAccount
+	}
+	if !mailAllowed(from, v.To, db) {
+		return griperrors.MailNotAllowed
+	}
+	if db.GetMail(v.To, v.Dig) != nil {
+		return nil
+	}
+	var m gripdata.Mail
+	m.To = v.To
+	m.From = from
+	m.Dig = v.Dig
+	m.Data = v.Data
+	m.Size = uint64(len(v.Data))
+	m.Timestamp = uint64(time.Now().UnixNano())
+	err = db.CheckUpdateStorageUsed(a, m.Size)
+	if err != nil {
+		return err
+	}
+	err = db.StoreMail(&m)
+	if err != nil {
+		db.FreeStorageUsed(a, m.Size)
+	}
+	return err
+}
+
+//mailItem is processed like the record arriving from the node
+//that created it, but the answer goes to the mailbox.  A record
+//we already have is only acknowledged, like a RespDig with HaveIt.
+//A record that is not what the mailbox says it is gets no answer.
+func (ctrl *ConnectionController) mailItem(v MailItem) {
+	d, err := DecodeMessage(v.Data)
+	if err == nil {
+		r, ok := d.(gripcrypto.SignInf)
+		if !ok || !bytes.Equal(r.Digest(), v.Dig) {
+			err = griperrors.MailInvalid
+		}
+	}
+	if err != nil {
+		log.Printf("Invalid mail from %s: %s",
+			base64.StdEncoding.EncodeToString(ctrl.C.GetNodeID()), err)
+		return
+	}
+	var a MailAck
+	a.Dig = v.Dig
+	if ctrl.DB.GetDigestData(v.Dig) == nil {
+		_, _, err = incomingRecord(d, ctrl.DB)
+	}
+	if err != nil {
+		log.Printf("Mail rejected: %s", err)
+		a.Message = err.Error()
+		a.Code = griperrors.Code(err)
+	}
+	ctrl.queueSend(a)
+}
+
+//mailAck frees the space the mail used.  The Mail is kept until
+//the node that left it is told.
+func (ctrl *ConnectionController) mailAck(v MailAck) {
+	to := ctrl.C.GetNodeID()
+	m, err := ctrl.DB.SetMailDelivered(to, v.Dig, v.Message, v.Code)
+	if err == nil && m != nil {
+		a := GetNodeAccount(to, ctrl.DB)
+		if a != nil {
+			_, err = ctrl.DB.FreeStorageUsed(a, m.Size)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to mark mail delivered: %s", err)
+	}
+}
+
+//mailReceipt is only believed from the mailbox we left the
+//record with, any other node could cancel our SendData
+func (ctrl *ConnectionController) mailReceipt(v MailReceipt) {
+	mb := ctrl.C.GetNodeID()
+	if ctrl.DB.GetMailDeposited(mb, v.To, v.Dig) == nil {
+		log.Printf("Ignoring receipt for mail we did not leave with %s",
+			base64.StdEncoding.EncodeToString(mb))
+		return
+	}
+	if v.Message != "" {
+		var r gripdata.RejectedSendData
+		r.Dig = v.Dig
+		r.TargetID = v.To
+		r.Timestamp = uint64(time.Now().UnixNano())
+		r.Message = renderReason(v.Code, v.Message, ctrl.DB)
+		r.Code = v.Code
+		if d := ctrl.DB.GetDigestData(v.Dig); d != nil {
+			r.TypeName = WireTypeName(d)
+		}
+		err := ctrl.DB.StoreRejectedSendData(&r)
+		if err != nil {
+			log.Printf("Failed to store rejection: %s", err)
+		}
+	}
+	_, err := ctrl.DB.DeleteSendData(v.Dig, v.To)
+	if err != nil {
+		log.Printf("Failed to delete SendData! %s", err)
+	}
+	err = ctrl.DB.DeleteMailDeposited(mb, v.To, v.Dig)
+	if err != nil {
+		log.Printf("Failed to delete mail deposit: %s", err)
+	}
+}
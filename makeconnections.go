@@ -3,15 +3,62 @@ package grip
 import (
 	"encoding/base64"
 	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/wyathan/grip/gripdata"
 )
 
+//ReconnectBackoff how long to wait before trying a node again
+//after failures failed attempts in a row.  It starts at
+//TRYCONNECTAGAINAFTERFAIL and doubles with each failure, up to
+//MAXRECONNECTBACKOFF, then is moved by up to RECONNECTJITTER.
+func ReconnectBackoff(failures uint32) time.Duration {
+	d := TRYCONNECTAGAINAFTERFAIL
+	for c := uint32(1); c < failures && d < MAXRECONNECTBACKOFF; c++ {
+		d *= 2
+	}
+	if d > MAXRECONNECTBACKOFF {
+		d = MAXRECONNECTBACKOFF
+	}
+	j := (rand.Float64()*2 - 1) * RECONNECTJITTER
+	return d + time.Duration(float64(d)*j)
+}
+
+//NodeHealth scores how reliably we reach a node, from 0 to 1.
+//A node is healthy if our last attempt to connect worked, or we
+//have never tried.  Each failure since then halves the score.
+func NodeHealth(e *gripdata.NodeEphemera) float64 {
+	if e.LastConnection >= e.LastConnAttempt {
+		return 1
+	}
+	h := 1.0
+	for c := uint32(0); c < e.ConnFailures && h > 0; c++ {
+		h /= 2
+	}
+	return h
+}
+
+//connectFailed try the node again after the backoff for one
+//more failure than it already had
+func (s *SocketController) connectFailed(id []byte, failures uint32) {
+	nt := uint64(time.Now().UnixNano())
+	bo := ReconnectBackoff(failures + 1)
+	s.DB.SetNodeEphemeraFailed(id, nt, nt+uint64(bo.Nanoseconds()))
+}
+
 func (s *SocketController) connectToNodeEphemera(c *gripdata.NodeEphemera) {
-	if s.DB.CanNodeEphemeraGoPending(c.ID) {
+	if !c.Connectable {
+		s.connectThroughRelay(c)
+	} else if s.DB.CanNodeEphemeraGoPending(c.ID) {
 		n := s.DB.GetNode(c.ID)
-		con, err := s.S.ConnectTo(n)
+		var con Connection
+		var err error
+		if n != nil {
+			con, err = s.S.ConnectTo(n)
+		}
 		if con != nil && err == nil {
 			s.buildConnectionController(con, false)
 		} else {
@@ -19,8 +66,7 @@ func (s *SocketController) connectToNodeEphemera(c *gripdata.NodeEphemera) {
 				con.Close()
 			}
 			log.Print("Connection error\n")
-			nt := uint64(time.Now().UnixNano())
-			s.DB.SetNodeEphemeraNextConnection(c.ID, nt, nt+uint64(TRYCONNECTAGAINAFTERFAIL.Nanoseconds()))
+			s.connectFailed(c.ID, c.ConnFailures)
 		}
 	}
 }
@@ -41,9 +87,20 @@ func (s *SocketController) connectTo(dbf getConnectable, attempted *map[string]u
 	nt := uint64(time.Now().UnixNano())
 	nm := s.numberConnections()
 	if nm <= MAXCONNECTIONS {
-		cl := dbf(MAXCONNECTIONATTEMPTS, nt)
+		cl := dbf(MAXCONNECTIONCANDIDATES, nt)
+		//Try the nodes we can reach first
+		sort.SliceStable(cl, func(i, j int) bool {
+			return NodeHealth(&cl[i]) > NodeHealth(&cl[j])
+		})
+		n := 0
 		for _, c := range cl {
+			if n >= MAXCONNECTIONATTEMPTS {
+				break
+			}
 			if s.canAttempt(attempted, c.ID, nt) {
+				n++
+				//Each dial can block, the routine is not stuck
+				s.connectLooped()
 				s.connectToNodeEphemera(&c)
 			}
 		}
@@ -53,6 +110,9 @@ func (s *SocketController) connectTo(dbf getConnectable, attempted *map[string]u
 func (s *SocketController) connectToNodesWithSendData(attempted *map[string]uint64) {
 	s.connectTo(s.DB.GetConnectableNodesWithSendData, attempted)
 }
+func (s *SocketController) connectToNodesThroughRelay(attempted *map[string]uint64) {
+	s.connectTo(s.DB.GetUnconnectableNodesWithSendData, attempted)
+}
 func (s *SocketController) connectToNodesWithShareNodeKey(attempted *map[string]uint64) {
 	s.connectTo(s.DB.GetConnectableNodesWithShareNodeKey, attempted)
 }
@@ -68,12 +128,22 @@ func (s *SocketController) connectToAnyNodes(attempted *map[string]uint64) {
 
 func (s *SocketController) connectRoutine() {
 	attempted := make(map[string]uint64)
-	for !s.Done {
+	for !s.IsDone() {
 		s.connectToNodesWithSendData(&attempted)
+		s.connectToNodesThroughRelay(&attempted)
+		s.connectToNodesWithFileTransfers(&attempted)
 		s.connectToNodesWithShareNodeKey(&attempted)
 		s.connectToNodesWithUseShareKey(&attempted)
-		time.Sleep(CONNECTROUTINESLEEP)
+		if !s.sleep(CONNECTROUTINESLEEP) {
+			return
+		}
 		s.connectToAnyNodes(&attempted)
 		s.checkConnections()
+		s.connectLooped()
 	}
 }
+
+//connectLooped the connect routine is still making progress
+func (s *SocketController) connectLooped() {
+	atomic.StoreUint64(&s.LastLoop, uint64(time.Now().UnixNano()))
+}
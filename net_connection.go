@@ -0,0 +1,93 @@
+package grip
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//HANDSHAKETIMEOUT is how long we give a new stream
+//connection to prove who it is
+const HANDSHAKETIMEOUT time.Duration = 10 * time.Second
+
+//NetConnection is a Connection over a stream such
+//as a TCP socket.  After the handshake every frame is
+//encrypted with keys only the two nodes know.
+type NetConnection struct {
+	sync.Mutex
+	conn      net.Conn
+	nodeID    []byte
+	send      *sessionCipher
+	recv      *sessionCipher
+	closeOnce sync.Once
+}
+
+//NewNetConnection runs the handshake with the node on the other
+//end of conn, which must prove it owns the key for the id it claims.
+//The dialing side must set id to the node it expects to reach.
+func NewNetConnection(conn net.Conn, id []byte, db Nodedb) (*NetConnection, error) {
+	return newNetConnection(conn, id, db, time.Now().Add(HANDSHAKETIMEOUT))
+}
+
+//newNetConnection the handshake must finish by dl
+func newNetConnection(conn net.Conn, id []byte, db Nodedb, dl time.Time) (*NetConnection, error) {
+	var c NetConnection
+	c.conn = conn
+	conn.SetDeadline(dl)
+	ses, err := handshake(&c, id != nil, id, db)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.nodeID = ses.node.ID
+	c.send = ses.send
+	c.recv = ses.recv
+	return &c, nil
+}
+
+//Read the next message from the stream
+func (c *NetConnection) Read() (interface{}, error) {
+	b, err := ReadFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if c.recv != nil {
+		b, err = c.recv.open(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return DecodeMessage(b)
+}
+
+//Send a message on the stream
+func (c *NetConnection) Send(d interface{}) error {
+	b, err := EncodeMessage(d)
+	if err != nil {
+		return err
+	}
+	return c.SendEncoded(b)
+}
+
+//SendEncoded a message encoded with EncodeMessage on the stream
+func (c *NetConnection) SendEncoded(b []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.send != nil {
+		b = c.send.seal(b)
+	}
+	return WriteFrame(c.conn, b)
+}
+
+//GetNodeID the id of the node on the other end
+func (c *NetConnection) GetNodeID() []byte {
+	return c.nodeID
+}
+
+//Close the stream, this unblocks Read and any blocked Send
+func (c *NetConnection) Close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+	})
+}
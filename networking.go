@@ -1,6 +1,7 @@
 package grip
 
 import (
+	"sort"
 	"time"
 
 	"github.com/wyathan/grip/gripdata"
@@ -14,14 +15,20 @@ const MAXSEND int = 10
 //querying the database for new data to send
 const SLEEPONNOSEND time.Duration = 1 * time.Second
 
-//BUFFERSIZE is the send channel size
-//Note: The test network sometimes results in a deadlock where
-//the ReadRoutine will block because the SendChan is full.
-//The WriteRoutine won't clear SendChan because it's blocked
-//trying to add to the testnetwork Send channel.  It is full because
-//the other end of the connection's ReadRoutine is also blocked, etc.
-//Increasing this value mitigates this issue.
-const BUFFERSIZE int = 20
+//MAXPENDING is the most digests we offer a node before it
+//answers for them.  This keeps a node from being sent more
+//than it can keep up with.
+const MAXPENDING int = 50
+
+//MAXQUEUE is the most messages waiting to be sent on a connection.
+//Every message the other node sends us queues at most one reply,
+//so a well behaved node that honors MAXPENDING never fills it.
+//If it fills we stop reading until there is room.
+const MAXQUEUE int = 1000
+
+//SENDQUEUEWAIT how long we stop reading for room in a full send
+//queue before the connection is closed
+const SENDQUEUEWAIT time.Duration = 10 * time.Second
 
 //MAXCONNECTIONS is the maximum number of connections we allow
 const MAXCONNECTIONS int = 1000
@@ -29,10 +36,22 @@ const MAXCONNECTIONS int = 1000
 //MAXCONNECTIONATTEMPTS number of connections to attempt at once
 const MAXCONNECTIONATTEMPTS int = 20
 
+//MAXCONNECTIONCANDIDATES number of nodes looked at to pick the
+//healthiest MAXCONNECTIONATTEMPTS to try
+const MAXCONNECTIONCANDIDATES int = 5 * MAXCONNECTIONATTEMPTS
+
 //TRYCONNECTAGAINAFTERFAIL how long to wait until we try to connect
-//again after we've failed
+//again after we've failed once.  It doubles with each failure
+//after that.
 const TRYCONNECTAGAINAFTERFAIL time.Duration = 1 * time.Second
 
+//MAXRECONNECTBACKOFF the longest we wait to try a node again
+const MAXRECONNECTBACKOFF time.Duration = 10 * time.Minute
+
+//RECONNECTJITTER is the fraction the backoff is randomly moved
+//by, so nodes that failed together do not all try again together
+const RECONNECTJITTER float64 = 0.2
+
 //WAITUNTILCONNECTAGAIN give connections this amount of time to
 //become established and upated in the database before we try
 //to connect again.  It should take less time than this for both
@@ -54,6 +73,13 @@ type Connection interface {
 	Close()            //Must cause blocking read to immediately exit
 }
 
+//EncodedSender is a Connection that can send a message already
+//encoded with EncodeMessage.  Messages are then only encoded once
+//to be sent and counted.
+type EncodedSender interface {
+	SendEncoded(b []byte) error
+}
+
 //Socket handles making connections and accepting them
 type Socket interface {
 	ConnectTo(n *gripdata.Node) (Connection, error)
@@ -61,6 +87,29 @@ type Socket interface {
 	Close()
 }
 
+//NodeURLs the addresses to try for a node, lowest Priority
+//first.  The URL is tried after the Addresses if it is not one
+//of them.
+func NodeURLs(n *gripdata.Node) []string {
+	al := make([]gripdata.NodeAddress, len(n.Addresses))
+	copy(al, n.Addresses)
+	sort.SliceStable(al, func(i, j int) bool {
+		return al[i].Priority < al[j].Priority
+	})
+	var ul []string
+	have := make(map[string]bool)
+	for _, a := range al {
+		if a.URL != "" && !have[a.URL] {
+			have[a.URL] = true
+			ul = append(ul, a.URL)
+		}
+	}
+	if n.URL != "" && !have[n.URL] {
+		ul = append(ul, n.URL)
+	}
+	return ul
+}
+
 //CheckDig check if a node has a digest you want to send it
 type CheckDig struct {
 	Dig []byte
@@ -82,6 +131,7 @@ type SendDig struct {
 type RejectDig struct {
 	Dig     []byte
 	Message string
+	Code    int //griperrors code for why, zero if it has none
 }
 
 //AckDig indicates the receiving node got the data
@@ -89,6 +139,28 @@ type AckDig struct {
 	Dig []byte
 }
 
+//FILECHUNKSIZE the most file data sent in one FileChunk
+const FILECHUNKSIZE int = 64 * 1024
+
+//FILECHUNKWINDOW the number of FileChunks asked for at once
+const FILECHUNKWINDOW uint32 = 4
+
+//FileChunkReq asks for the data behind a ContextFile
+//starting at Offset
+type FileChunkReq struct {
+	Dig    []byte //The ContextFile Dig
+	Offset uint64
+	Window uint32 //The number of chunks to send
+}
+
+//FileChunk is part of the data behind a ContextFile
+type FileChunk struct {
+	Dig    []byte //The ContextFile Dig
+	Offset uint64
+	Data   []byte
+	Last   bool //This is the end of the file
+}
+
 //ReqContextFile requests a ContextFile be (re)sent
 //to this node.  Most likely so that it can just
 //send it along to another node.
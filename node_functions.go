@@ -4,9 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
-	"errors"
 	"log"
-	"reflect"
 	"time"
 
 	"encoding/base64"
@@ -231,7 +229,7 @@ func CreateNewSend(v gripcrypto.SignInf, sendto []byte, db DB) error {
 	var s gripdata.SendData
 	s.Dig = v.GetDig()
 	s.TargetID = sendto
-	s.TypeName = reflect.TypeOf(v).String()
+	s.TypeName = WireTypeName(v)
 	s.Timestamp = uint64(time.Now().UnixNano())
 	err := db.StoreSendData(&s)
 	if err != nil {
@@ -266,6 +264,25 @@ func CreateNewNode(pr *gripdata.MyNodePrivateData, n *gripdata.Node, db Nodedb)
 	return nil
 }
 
+//UpdateMyNode signs n as the next version of this node and sends
+//it to every node we share with.  The ID and PublicKey are kept.
+func UpdateMyNode(n *gripdata.Node, db DB) error {
+	myn, pr := db.GetPrivateNodeData()
+	n.ID = myn.ID
+	n.PublicKey = myn.PublicKey
+	n.Seq = myn.Seq + 1
+	err := gripcrypto.Sign(n, pr.PrivateKey)
+	if err != nil {
+		return err
+	}
+	err = db.StoreMyPrivateNodeData(n, pr)
+	if err != nil {
+		return err
+	}
+	_, err = SendAllToShareWithMe(n, db)
+	return err
+}
+
 //AssociateNodeAccoutKey associates this node with an account
 //on another node
 func AssociateNodeAccoutKey(key string, tnid []byte, db DB) error {
@@ -299,14 +316,14 @@ func SignNodeSig(s gripcrypto.SignInf, db DB) (bool, error) {
 func VerifyNodeSig(s gripcrypto.SignInf, db DB) (bool, error) {
 	nodeid := s.GetNodeID()
 	if nodeid == nil {
-		return false, errors.New("NodeID was not set")
+		return false, griperrors.NodeIDNotSet
 	}
 	nodedata := db.GetNode(nodeid)
 	if nodedata == nil {
-		return false, errors.New("Node was not found in db")
+		return false, griperrors.NodeNotFound
 	}
 	if !gripcrypto.Verify(s, nodedata.PublicKey) {
-		return false, errors.New("Signature was not valid")
+		return false, griperrors.InvalidSignature
 	}
 	return true, nil
 }
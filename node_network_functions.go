@@ -3,7 +3,6 @@ package grip
 import (
 	"bytes"
 	"crypto/sha512"
-	"errors"
 	"log"
 
 	"github.com/wyathan/grip/gripcrypto"
@@ -27,6 +26,17 @@ func StoreNode(c *gripdata.Node, db DB) (bool, error) {
 	return true, db.StoreNode(c)
 }
 
+//NewerNode only lets through a Node with a larger Seq than the one
+//we have, so an old record sent again cannot replace a new one.
+//The record we already have is let through.
+func NewerNode(n *gripdata.Node, db DB) (bool, error) {
+	kn := db.GetNode(n.ID)
+	if kn == nil || bytes.Equal(kn.Dig, n.Dig) || kn.Seq < n.Seq {
+		return true, nil
+	}
+	return false, griperrors.NodeOutdated
+}
+
 func CreateNodeEphemera(n *gripdata.Node, db DB) (bool, error) {
 	return true, db.CreateNodeEphemera(n.ID, n.Connectable)
 }
@@ -45,6 +55,7 @@ func IncomingNode(n *gripdata.Node, db DB) error {
 	var p SProcChain
 	p.Push(LocallyCreated)
 	p.Push(NodeProc(VerifyNode))
+	p.Push(NodeProc(NewerNode))
 	p.Push(NodeProc(StoreNode))
 	p.Push(NodeProc(CreateNodeEphemera))
 	p.Push(SendAllToShareWithMe)
@@ -175,16 +186,16 @@ func IncomingUseShareNodeKey(k *gripdata.UseShareNodeKey, db DB) error {
 //VerifyNode verify new node data
 func VerifyNode(n *gripdata.Node, db DB) (bool, error) {
 	if n.PublicKey == nil || n.ID == nil {
-		return false, errors.New("Public key and ID must be specified")
+		return false, griperrors.NodeKeyMissing
 	}
 	h := sha512.New()
 	gripcrypto.HashBytes(h, n.PublicKey)
 	tid := h.Sum(nil)
 	if !bytes.Equal(n.ID, tid) {
-		return false, errors.New("ID does not match public key")
+		return false, griperrors.NodeIDMismatch
 	}
 	if !gripcrypto.Verify(n, n.PublicKey) {
-		return false, errors.New("Failed to verify signature")
+		return false, griperrors.InvalidSignature
 	}
 	return true, nil
 }
@@ -0,0 +1,276 @@
+package grip
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/wyathan/grip/gripcrypto"
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//ORPHANTTL how long a record waits for a record it needs before
+//it is rejected
+const ORPHANTTL time.Duration = 5 * time.Minute
+
+//MAXORPHANS the most records that wait at once.  Past it they are
+//rejected right away.
+const MAXORPHANS int = 1000
+
+//orphan a record that came before a record it needs
+type orphan struct {
+	name    string
+	rec     interface{}
+	dig     []byte
+	key     string //What it waits for
+	err     error  //Why it waits, it is rejected with this if it expires
+	ctrl    *ConnectionController
+	expires time.Time
+	ready   bool
+}
+
+//OrphanPool records that came before a record they need.  They
+//wait until it comes on any connection, and are then processed
+//again for the connection they came on.
+type OrphanPool struct {
+	sync.Mutex
+	TTL     time.Duration //Set before Start
+	Max     int           //Set before Start
+	waiting map[string][]*orphan
+	held    map[*ConnectionController][]*orphan
+	digs    map[string]bool
+}
+
+//NewOrphanPool an empty pool with the default limits
+func NewOrphanPool() *OrphanPool {
+	var p OrphanPool
+	p.TTL = ORPHANTTL
+	p.Max = MAXORPHANS
+	p.waiting = make(map[string][]*orphan)
+	p.held = make(map[*ConnectionController][]*orphan)
+	p.digs = make(map[string]bool)
+	return &p
+}
+
+//Len the number of records waiting
+func (p *OrphanPool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.digs)
+}
+
+//hold false if the pool is full or the record already waits
+func (p *OrphanPool) hold(o *orphan) bool {
+	p.Lock()
+	defer p.Unlock()
+	ds := base64.StdEncoding.EncodeToString(o.dig)
+	if len(p.digs) >= p.Max || p.digs[ds] {
+		return false
+	}
+	p.digs[ds] = true
+	p.waiting[o.key] = append(p.waiting[o.key], o)
+	p.held[o.ctrl] = append(p.held[o.ctrl], o)
+	return true
+}
+
+//landed the records waiting for keys are ready.  Each connection
+//holding one is woken, it may not read anything else for a while.
+//Only called from routines the SocketController tracks.
+func (p *OrphanPool) landed(keys []string) {
+	wake := make(map[*ConnectionController]bool)
+	p.Lock()
+	for _, k := range keys {
+		for _, o := range p.waiting[k] {
+			o.ready = true
+			wake[o.ctrl] = true
+		}
+		delete(p.waiting, k)
+	}
+	p.Unlock()
+	for c := range wake {
+		if c.SocketCtrl != nil {
+			c.SocketCtrl.goRoutine(fmt.Sprintf("orphans %d", c.ConID), c.retryOrphans)
+		}
+	}
+}
+
+//take the records held for ctrl that are ready or have expired
+func (p *OrphanPool) take(ctrl *ConnectionController, now time.Time) []*orphan {
+	p.Lock()
+	defer p.Unlock()
+	var keep, r []*orphan
+	for _, o := range p.held[ctrl] {
+		if o.ready || now.After(o.expires) {
+			p.remove(o)
+			r = append(r, o)
+		} else {
+			keep = append(keep, o)
+		}
+	}
+	if len(keep) == 0 {
+		delete(p.held, ctrl)
+	} else {
+		p.held[ctrl] = keep
+	}
+	return r
+}
+
+//drop every record held for ctrl.  The other node still has them
+//to send again.
+func (p *OrphanPool) drop(ctrl *ConnectionController) {
+	p.Lock()
+	defer p.Unlock()
+	for _, o := range p.held[ctrl] {
+		p.remove(o)
+	}
+	delete(p.held, ctrl)
+}
+
+//remove must hold the lock.  It leaves held to the caller.
+func (p *OrphanPool) remove(o *orphan) {
+	delete(p.digs, base64.StdEncoding.EncodeToString(o.dig))
+	var wl []*orphan
+	for _, w := range p.waiting[o.key] {
+		if w != o {
+			wl = append(wl, w)
+		}
+	}
+	if len(wl) == 0 {
+		delete(p.waiting, o.key)
+	} else {
+		p.waiting[o.key] = wl
+	}
+}
+
+func nodeKey(id []byte) string {
+	return "node " + base64.StdEncoding.EncodeToString(id)
+}
+
+func contextKey(cid []byte) string {
+	return "context " + base64.StdEncoding.EncodeToString(cid)
+}
+
+func pairKey(cid []byte, id []byte) string {
+	return "pair " + base64.StdEncoding.EncodeToString(cid) + " " + base64.StdEncoding.EncodeToString(id)
+}
+
+func fileKey(dd []byte) string {
+	return "file " + base64.StdEncoding.EncodeToString(dd)
+}
+
+func recordContext(rec interface{}) []byte {
+	switch v := rec.(type) {
+	case *gripdata.ContextRequest:
+		return v.ContextDig
+	case *gripdata.ContextResponse:
+		return v.ContextDig
+	case *gripdata.ContextFile:
+		return v.Context
+	case *gripdata.ContextFileTransfer:
+		return v.Context
+	}
+	return nil
+}
+
+//orphanKey what rec waits for, or "" if err is not for a missing
+//record
+func orphanKey(rec interface{}, err error, db DB) string {
+	s, ok := rec.(gripcrypto.SignInf)
+	if !ok {
+		return ""
+	}
+	switch err {
+	case griperrors.NodeNotFound:
+		return nodeKey(s.GetNodeID())
+	case griperrors.ContextNotFound:
+		return contextKey(recordContext(rec))
+	case griperrors.ContextPairNotFound:
+		return pairKey(recordContext(rec), s.GetNodeID())
+	case griperrors.ContextFileParentNotFound:
+		if cf, ok := rec.(*gripdata.ContextFile); ok {
+			return fileKey(MissingContextFileParent(cf, db))
+		}
+	}
+	return ""
+}
+
+//landedKeys what records may have been waiting for rec
+func landedKeys(rec interface{}) []string {
+	switch v := rec.(type) {
+	case *gripdata.Node:
+		return []string{nodeKey(v.ID)}
+	case *gripdata.Context:
+		return []string{contextKey(v.Dig)}
+	case *gripdata.ContextRequest:
+		return []string{pairKey(v.ContextDig, v.TargetNodeID)}
+	case *gripdata.ContextResponse:
+		return []string{pairKey(v.ContextDig, v.TargetNodeID)}
+	case *gripdata.ContextFile:
+		return []string{fileKey(v.DataDepDig)}
+	}
+	return nil
+}
+
+//holdOrphan keeps rec to process again once the record it needs
+//is here.  False if err is not for a missing record, or it cannot
+//wait, so it should be rejected.
+func (ctrl *ConnectionController) holdOrphan(name string, rec interface{}, dig []byte, err error) bool {
+	if ctrl.SocketCtrl == nil || err == nil {
+		return false
+	}
+	key := orphanKey(rec, err, ctrl.DB)
+	if key == "" {
+		return false
+	}
+	p := ctrl.SocketCtrl.Orphans
+	o := &orphan{name: name, rec: rec, dig: dig, key: key, err: err, ctrl: ctrl, expires: time.Now().Add(p.TTL)}
+	if !p.hold(o) {
+		return false
+	}
+	log.Printf("%s data waits for %s: %s", name, key, err)
+	//It is answered on its own once it is processed
+	ctrl.unwant(dig)
+	return true
+}
+
+//orphansLanded wakes the records waiting for the one we just got
+func (ctrl *ConnectionController) orphansLanded(dig []byte) {
+	if ctrl.SocketCtrl != nil {
+		ctrl.SocketCtrl.Orphans.landed(landedKeys(ctrl.DB.GetDigestData(dig)))
+	}
+}
+
+//retryOrphans processes the records that came on this connection
+//and are ready, and rejects the ones that waited too long
+func (ctrl *ConnectionController) retryOrphans() {
+	if ctrl.SocketCtrl == nil {
+		return
+	}
+	ctrl.recLock.Lock()
+	defer ctrl.recLock.Unlock()
+	if ctrl.IsDone() {
+		return
+	}
+	for _, o := range ctrl.SocketCtrl.Orphans.take(ctrl, time.Now()) {
+		if !o.ready {
+			ctrl.processSendError(o.name, o.dig, o.err)
+		} else if cf, ok := o.rec.(*gripdata.ContextFile); ok {
+			ctrl.incomingContextFile(cf)
+		} else {
+			ctrl.processRecord(o.rec)
+		}
+	}
+}
+
+//dropOrphans waits for any orphans being processed.  The
+//connection is Done, so none are processed after.
+func (ctrl *ConnectionController) dropOrphans() {
+	if ctrl.SocketCtrl != nil {
+		ctrl.recLock.Lock()
+		ctrl.SocketCtrl.Orphans.drop(ctrl)
+		ctrl.recLock.Unlock()
+	}
+}
@@ -0,0 +1,247 @@
+package grip
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//THROUGHPUTWINDOW how far back the rate in a Throughput looks.
+//Older traffic counts for less and less.
+const THROUGHPUTWINDOW time.Duration = 5 * time.Second
+
+//FILECHUNKOVERHEAD about what a FileChunk adds to its data on
+//the wire
+const FILECHUNKOVERHEAD uint64 = 128
+
+//BandwidthLimits are the bytes per second we send.  Zero is no
+//limit.  Per Account limits are Account.MaxSendRate.
+type BandwidthLimits struct {
+	Global          uint64 //Everything we send
+	GlobalFiles     uint64 //File data we send
+	Connection      uint64 //Everything sent on one connection
+	ConnectionFiles uint64 //File data sent on one connection
+}
+
+//Throughput what has been sent
+type Throughput struct {
+	Sent     uint64  //Bytes sent
+	Rate     float64 //Bytes per second recently
+	FileSent uint64  //Bytes of file data sent
+	FileRate float64 //Bytes per second of file data recently
+}
+
+//RateLimit is a token bucket that also measures what goes
+//through it.  It holds at most one second of tokens.  A nil
+//RateLimit does nothing.
+type RateLimit struct {
+	sync.Mutex
+	Rate   uint64 //Bytes per second, zero for no limit
+	tokens float64
+	last   time.Time
+	sent   uint64
+	avg    float64
+}
+
+//NewRateLimit a bucket for rate bytes per second that starts full
+func NewRateLimit(rate uint64) *RateLimit {
+	var r RateLimit
+	r.Rate = rate
+	r.tokens = float64(rate)
+	r.last = time.Now()
+	return &r
+}
+
+//update must hold the lock
+func (r *RateLimit) update(now time.Time) {
+	el := now.Sub(r.last).Seconds()
+	if el <= 0 {
+		return
+	}
+	r.last = now
+	r.avg *= math.Exp(-el / THROUGHPUTWINDOW.Seconds())
+	r.tokens = math.Min(r.tokens+el*float64(r.Rate), float64(r.Rate))
+}
+
+//Take charges n bytes.  The bucket may go into debt, a message
+//that has been sent has been sent.
+func (r *RateLimit) Take(n uint64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.update(time.Now())
+	r.sent += n
+	r.avg += float64(n) / THROUGHPUTWINDOW.Seconds()
+	if r.Rate > 0 {
+		r.tokens -= float64(n)
+	}
+}
+
+//Wait how long until the bucket is out of debt
+func (r *RateLimit) Wait() time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.update(time.Now())
+	if r.Rate == 0 || r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / float64(r.Rate) * float64(time.Second))
+}
+
+//Throughput bytes sent and the recent bytes per second
+func (r *RateLimit) Throughput() (uint64, float64) {
+	if r == nil {
+		return 0, 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.update(time.Now())
+	return r.sent, r.avg
+}
+
+//trafficLimits the buckets for one kind of traffic
+type trafficLimits []*RateLimit
+
+func (l trafficLimits) take(n uint64) {
+	for _, r := range l {
+		r.Take(n)
+	}
+}
+
+func (l trafficLimits) wait() time.Duration {
+	var w time.Duration
+	for _, r := range l {
+		if d := r.Wait(); d > w {
+			w = d
+		}
+	}
+	return w
+}
+
+func newThroughput(all *RateLimit, files *RateLimit) Throughput {
+	var t Throughput
+	t.Sent, t.Rate = all.Throughput()
+	t.FileSent, t.FileRate = files.Throughput()
+	return t
+}
+
+//startLimits builds the global buckets from Bandwidth.  The
+//Account buckets are built as they are needed.
+func (s *SocketController) startLimits() {
+	s.sent = NewRateLimit(s.Bandwidth.Global)
+	s.fileSent = NewRateLimit(s.Bandwidth.GlobalFiles)
+}
+
+//accountLimit the bucket shared by every connection to nodes of
+//the Account id is associated with, nil if it has none
+func (s *SocketController) accountLimit(id []byte) *RateLimit {
+	a := GetNodeAccount(id, s.DB)
+	if a == nil {
+		return nil
+	}
+	s.rateLock.Lock()
+	defer s.rateLock.Unlock()
+	r := s.accountSent[a.AccountID]
+	if r == nil {
+		r = NewRateLimit(a.MaxSendRate)
+		s.accountSent[a.AccountID] = r
+	} else {
+		r.Lock()
+		r.Rate = a.MaxSendRate
+		r.Unlock()
+	}
+	return r
+}
+
+//Throughput everything this node has sent
+func (s *SocketController) Throughput() Throughput {
+	return newThroughput(s.sent, s.fileSent)
+}
+
+//AccountThroughput what has been sent to the nodes of an Account
+//since we started
+func (s *SocketController) AccountThroughput(id string) Throughput {
+	s.rateLock.Lock()
+	r := s.accountSent[id]
+	s.rateLock.Unlock()
+	return newThroughput(r, nil)
+}
+
+//setLimits builds the buckets a new connection sends through
+func (ctrl *ConnectionController) setLimits(s *SocketController) {
+	ctrl.sent = NewRateLimit(s.Bandwidth.Connection)
+	ctrl.fileSent = NewRateLimit(s.Bandwidth.ConnectionFiles)
+	ctrl.limits = trafficLimits{s.sent, ctrl.sent, s.accountLimit(ctrl.C.GetNodeID())}
+	ctrl.fileLimits = append(trafficLimits{s.fileSent, ctrl.fileSent}, ctrl.limits...)
+}
+
+//Throughput what has been sent on this connection
+func (ctrl *ConnectionController) Throughput() Throughput {
+	return newThroughput(ctrl.sent, ctrl.fileSent)
+}
+
+//sendCounted sends d and charges it to the buckets.  Only file
+//data is ever held back to wait for them, everything else just
+//uses up tokens the file data then waits for.
+func (ctrl *ConnectionController) sendCounted(d interface{}) error {
+	if c, ok := d.(compressedFile); ok {
+		err := ctrl.C.Send(Compressed(c))
+		if err == nil {
+			ctrl.fileLimits.take(uint64(len(c.Data)) + FILECHUNKOVERHEAD)
+		}
+		return err
+	}
+	if ch, ok := d.(FileChunk); ok {
+		err := ctrl.C.Send(d)
+		if err == nil {
+			ctrl.fileLimits.take(uint64(len(ch.Data)) + FILECHUNKOVERHEAD)
+		}
+		return err
+	}
+	b, err := EncodeMessage(d)
+	if err != nil {
+		return err
+	}
+	if es, ok := ctrl.C.(EncodedSender); ok {
+		err = es.SendEncoded(b)
+	} else {
+		//It is encoded again to be sent
+		err = ctrl.C.Send(d)
+	}
+	if err == nil {
+		ctrl.limits.take(uint64(len(b)))
+	}
+	return err
+}
+
+//throttled true if new records should wait for the buckets
+func (ctrl *ConnectionController) throttled() bool {
+	return ctrl.limits.wait() > 0
+}
+
+//waitForFileTokens false if file data has to wait.  It waits
+//until there are tokens, or a control message is queued.
+func (ctrl *ConnectionController) waitForFileTokens() bool {
+	w := ctrl.fileLimits.wait()
+	if w <= 0 {
+		return true
+	}
+	t := time.NewTimer(w)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctrl.Queue.Ready():
+		//Put it back so sendSelect still wakes up for it
+		select {
+		case ctrl.Queue.ready <- true:
+		default:
+		}
+	case <-ctrl.Queue.Done():
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package grip
+
+import (
+	"log"
+	"time"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//REJECTRETRY how long after a transient rejection the data is
+//sent again.  It doubles every time it is rejected again.
+const REJECTRETRY time.Duration = 10 * time.Minute
+
+//MAXREJECTRETRIES how many times rejected data is sent again
+//before it is left for someone to look at
+const MAXREJECTRETRIES uint32 = 5
+
+//renderReason the message for a rejection in our Locale.  A code
+//we do not know keeps the other node's message.
+func renderReason(code int, msg string, db DB) string {
+	_, pr := db.GetPrivateNodeData()
+	return griperrors.Render(code, pr.Locale, msg)
+}
+
+//RequeueRejectedSendData sends rejected data to its target again
+func RequeueRejectedSendData(r *gripdata.RejectedSendData, db DB) error {
+	var s gripdata.SendData
+	s.Dig = r.Dig
+	s.TargetID = r.TargetID
+	s.TypeName = r.TypeName
+	s.Timestamp = uint64(time.Now().UnixNano())
+	s.Retries = r.Retries + 1
+	err := db.StoreSendData(&s)
+	if err != nil {
+		return err
+	}
+	return db.DeleteRejectedSendData(r.Dig, r.TargetID)
+}
+
+//retryDue true if the rejection was transient and it has waited
+//long enough
+func retryDue(r *gripdata.RejectedSendData, iv time.Duration, max uint32, now uint64) bool {
+	if !griperrors.IsTransient(r.Code) || r.Retries >= max {
+		return false
+	}
+	return r.Timestamp+uint64(iv.Nanoseconds())<<r.Retries <= now
+}
+
+//RetryRejected requeues every transient rejection that is due.
+//Returns the number requeued.
+func RetryRejected(db DB, iv time.Duration, max uint32, now uint64) (int, error) {
+	n := 0
+	for _, r := range db.ListRejectedSendData(nil, "") {
+		if !retryDue(&r, iv, max, now) {
+			continue
+		}
+		err := RequeueRejectedSendData(&r, db)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+//retryRoutine sends data again that was rejected for a
+//transient reason
+func (s *SocketController) retryRoutine() {
+	for s.sleep(s.RejectRetry) {
+		n, err := RetryRejected(s.DB, s.RejectRetry, s.MaxRetries, uint64(time.Now().UnixNano()))
+		if err != nil {
+			log.Printf("Failed to send rejected data again: %s", err)
+		}
+		if n > 0 {
+			log.Printf("Sending %d rejected records again", n)
+		}
+	}
+}
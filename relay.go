@@ -0,0 +1,437 @@
+package grip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//CAPRELAY the node understands the relay messages, so it can
+//reach other nodes through a relay and be reached through one
+const CAPRELAY string = "relay"
+
+//RelayLimits turns on relaying for other nodes.  A SocketController
+//only relays if it has them, and only between nodes that both share
+//with it.  The bytes relayed are charged to the Account of the node
+//that asked for the relay.
+type RelayLimits struct {
+	MaxSessions int //Most relayed connections at once
+}
+
+//RelayReq asks the connected node to relay a connection to Target
+type RelayReq struct {
+	Session uint64 //Picked by the asking node
+	Target  []byte
+}
+
+//RelayOpen tells a node that From wants a relayed connection
+type RelayOpen struct {
+	Session uint64 //Picked by the relay
+	From    []byte
+}
+
+//RelayData is a frame on a relayed connection.  After the
+//handshake only the two ends can read it.
+type RelayData struct {
+	Session uint64
+	Frame   []byte
+}
+
+//RelayClose ends a relayed connection
+type RelayClose struct {
+	Session uint64
+	Message string
+}
+
+//RelayConnection is a Connection to a node through a relay.  It
+//runs the same handshake as a NetConnection, so the relay only
+//ever sees encrypted frames.
+type RelayConnection struct {
+	sync.Mutex
+	via       *ConnectionController //Our connection to the relay
+	session   uint64
+	nodeID    []byte
+	in        *SendQueue //Frames from the relay
+	send      *sessionCipher
+	recv      *sessionCipher
+	closeOnce sync.Once
+}
+
+func newRelayConnection(via *ConnectionController, session uint64, id []byte) *RelayConnection {
+	var c RelayConnection
+	c.via = via
+	c.session = session
+	c.nodeID = id
+	c.in = NewSendQueue(MAXQUEUE)
+	return &c
+}
+
+//Read the next message from the relay
+func (c *RelayConnection) Read() (interface{}, error) {
+	for {
+		f, ok := c.in.Pop()
+		if ok {
+			b := f.([]byte)
+			var err error
+			if c.recv != nil {
+				b, err = c.recv.open(b)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return DecodeMessage(b)
+		}
+		select {
+		case <-c.in.Ready():
+		case <-c.in.Done():
+			return nil, griperrors.ConnectionClosed
+		}
+	}
+}
+
+//Send a message through the relay.  Frames are queued in the
+//order they are sealed.
+func (c *RelayConnection) Send(d interface{}) error {
+	b, err := EncodeMessage(d)
+	if err != nil {
+		return err
+	}
+	return c.SendEncoded(b)
+}
+
+//SendEncoded a message encoded with EncodeMessage through the relay
+func (c *RelayConnection) SendEncoded(b []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.send != nil {
+		b = c.send.seal(b)
+	}
+	return c.via.Queue.Push(RelayData{Session: c.session, Frame: b})
+}
+
+//GetNodeID the id of the node on the other end
+func (c *RelayConnection) GetNodeID() []byte {
+	return c.nodeID
+}
+
+//Close the relayed connection and tell the relay
+func (c *RelayConnection) Close() {
+	c.closeOnce.Do(func() {
+		c.in.Close()
+		if c.via.removeRelayEnd(c) {
+			c.via.Queue.Push(RelayClose{Session: c.session})
+		}
+	})
+}
+
+//relayHandshake proves who is on each end of a relayed connection
+//before it is used like any other connection
+func (s *SocketController) relayHandshake(c *RelayConnection, dialer bool, failures uint32) {
+	t := time.AfterFunc(HANDSHAKETIMEOUT, c.Close)
+	ses, err := handshake(c, dialer, c.nodeID, s.DB)
+	if !t.Stop() && err == nil {
+		err = griperrors.ConnectionClosed
+	}
+	if err != nil {
+		log.Printf("Relay handshake failed: %s", err)
+		c.Close()
+		if dialer {
+			s.connectFailed(c.nodeID, failures)
+		}
+		return
+	}
+	c.Lock()
+	c.send = ses.send
+	c.recv = ses.recv
+	c.Unlock()
+	if !dialer {
+		//Creates the Node Ephemera for a new node
+		s.DB.CanNodeEphemeraGoPending(c.nodeID)
+	}
+	s.buildConnectionController(c, !dialer)
+}
+
+//introducedFeature HasFeature for routines other than the read
+//routine.  False until the Introduction has been read.
+func (ctrl *ConnectionController) introducedFeature(c string) bool {
+	select {
+	case <-ctrl.Introduced:
+		return ctrl.HasFeature(c)
+	default:
+		return false
+	}
+}
+
+func (ctrl *ConnectionController) addRelayEnd(c *RelayConnection) bool {
+	ctrl.relayLock.Lock()
+	defer ctrl.relayLock.Unlock()
+	if ctrl.relayEnds == nil {
+		return false
+	}
+	ctrl.relayEnds[c.session] = c
+	return true
+}
+
+//removeRelayEnd false if c was already removed
+func (ctrl *ConnectionController) removeRelayEnd(c *RelayConnection) bool {
+	ctrl.relayLock.Lock()
+	defer ctrl.relayLock.Unlock()
+	if ctrl.relayEnds[c.session] != c {
+		return false
+	}
+	delete(ctrl.relayEnds, c.session)
+	return true
+}
+
+func (ctrl *ConnectionController) getRelayEnd(session uint64) *RelayConnection {
+	ctrl.relayLock.Lock()
+	defer ctrl.relayLock.Unlock()
+	return ctrl.relayEnds[session]
+}
+
+//closeRelays closes every relayed connection that goes over this
+//one, whether we are an end or the relay
+func (ctrl *ConnectionController) closeRelays() {
+	ctrl.relayLock.Lock()
+	ends := ctrl.relayEnds
+	ctrl.relayEnds = nil
+	ctrl.relayLock.Unlock()
+	for _, c := range ends {
+		c.Close()
+	}
+	if ctrl.SocketCtrl != nil {
+		ctrl.SocketCtrl.closeRelaysOn(ctrl)
+	}
+}
+
+//relayOpen another node wants to reach us through this connection
+func (ctrl *ConnectionController) relayOpen(v RelayOpen) {
+	s := ctrl.SocketCtrl
+	if s == nil {
+		return
+	}
+	c := newRelayConnection(ctrl, v.Session, v.From)
+	if ctrl.addRelayEnd(c) {
+		s.goRoutine(fmt.Sprintf("relay %d", v.Session), func() {
+			s.relayHandshake(c, false, 0)
+		})
+	}
+}
+
+//relayData either for one of our relayed connections, or for us
+//to pass along
+func (ctrl *ConnectionController) relayData(v RelayData) {
+	c := ctrl.getRelayEnd(v.Session)
+	if c != nil {
+		if c.in.Push(v.Frame) != nil {
+			//The relayed connection is not keeping up
+			c.Close()
+		}
+		return
+	}
+	if ctrl.SocketCtrl != nil {
+		ctrl.SocketCtrl.forwardRelay(ctrl, v)
+	}
+}
+
+func (ctrl *ConnectionController) relayClose(v RelayClose) {
+	c := ctrl.getRelayEnd(v.Session)
+	if c != nil {
+		log.Printf("Relayed connection closed: %s", v.Message)
+		c.Close()
+		return
+	}
+	if ctrl.SocketCtrl != nil {
+		l := ctrl.SocketCtrl.getRelayLink(ctrl, v.Session)
+		if l != nil {
+			ctrl.SocketCtrl.closeRelayLink(l, v.Message)
+		}
+	}
+}
+
+func (ctrl *ConnectionController) relayReq(v RelayReq) {
+	if ctrl.SocketCtrl == nil {
+		return
+	}
+	err := ctrl.SocketCtrl.openRelay(ctrl, v)
+	if err != nil {
+		log.Printf("Relay refused: %s", err)
+		ctrl.queueSend(RelayClose{Session: v.Session, Message: err.Error()})
+	}
+}
+
+//relayKey a session on one connection
+type relayKey struct {
+	con     uint64
+	session uint64
+}
+
+//relayLink joins two connections we relay between
+type relayLink struct {
+	a    *ConnectionController //The node that asked for the relay
+	as   uint64
+	b    *ConnectionController
+	bs   uint64
+	acct *gripdata.Account //Charged for the relayed bytes
+}
+
+//other the connection and session on the other side from ctrl
+func (l *relayLink) other(ctrl *ConnectionController) (*ConnectionController, uint64) {
+	if ctrl == l.a {
+		return l.b, l.bs
+	}
+	return l.a, l.as
+}
+
+//sharesWith true if from shares its Node with to
+func sharesWith(from []byte, to []byte, db DB) bool {
+	for _, id := range FindAllToShareWith(from, db) {
+		if bytes.Equal(id, to) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SocketController) getConnection(id []byte) *ConnectionController {
+	s.Lock()
+	defer s.Unlock()
+	return s.Connections[base64.StdEncoding.EncodeToString(id)]
+}
+
+//openRelay checks the relay is allowed, then asks the target
+//node to open its end
+func (s *SocketController) openRelay(from *ConnectionController, v RelayReq) error {
+	if s.Relay == nil {
+		return griperrors.RelayNotEnabled
+	}
+	myn, _ := s.DB.GetPrivateNodeData()
+	fid := from.C.GetNodeID()
+	if !sharesWith(fid, myn.ID, s.DB) || !sharesWith(v.Target, myn.ID, s.DB) {
+		return griperrors.RelayNotShared
+	}
+	a := GetNodeAccount(fid, s.DB)
+	if a == nil || !a.Enabled || a.MaxRelayBytes == 0 {
+		return griperrors.RelayLimit
+	}
+	to := s.getConnection(v.Target)
+	if to == nil || to.IsDone() || !to.introducedFeature(CAPRELAY) {
+		return griperrors.RelayTargetNotConnected
+	}
+	if _, ok := to.C.(*RelayConnection); ok {
+		//No relaying through a relay
+		return griperrors.RelayTargetNotConnected
+	}
+	l := &relayLink{a: from, as: v.Session, b: to, bs: rand.Uint64(), acct: a}
+	s.relayLock.Lock()
+	if len(s.relays)/2 >= s.Relay.MaxSessions {
+		s.relayLock.Unlock()
+		return griperrors.RelayLimit
+	}
+	s.relays[relayKey{from.ConID, l.as}] = l
+	s.relays[relayKey{to.ConID, l.bs}] = l
+	s.relayLock.Unlock()
+	err := to.Queue.Push(RelayOpen{Session: l.bs, From: fid})
+	if err != nil {
+		s.closeRelayLink(l, err.Error())
+	}
+	return nil
+}
+
+func (s *SocketController) getRelayLink(ctrl *ConnectionController, session uint64) *relayLink {
+	s.relayLock.Lock()
+	defer s.relayLock.Unlock()
+	return s.relays[relayKey{ctrl.ConID, session}]
+}
+
+//forwardRelay pass a frame to the other side.  A frame left over
+//from a closed relay is dropped.
+func (s *SocketController) forwardRelay(from *ConnectionController, v RelayData) {
+	l := s.getRelayLink(from, v.Session)
+	if l == nil {
+		return
+	}
+	to, ts := l.other(from)
+	err := s.DB.CheckUpdateRelayUsed(l.acct, uint64(len(v.Frame)))
+	if err == nil {
+		err = to.Queue.Push(RelayData{Session: ts, Frame: v.Frame})
+	}
+	if err != nil {
+		s.closeRelayLink(l, err.Error())
+	}
+}
+
+//closeRelayLink tells both ends the relay is over
+func (s *SocketController) closeRelayLink(l *relayLink, msg string) {
+	s.relayLock.Lock()
+	open := s.relays[relayKey{l.a.ConID, l.as}] == l
+	if open {
+		delete(s.relays, relayKey{l.a.ConID, l.as})
+		delete(s.relays, relayKey{l.b.ConID, l.bs})
+	}
+	s.relayLock.Unlock()
+	if open {
+		l.a.Queue.Push(RelayClose{Session: l.as, Message: msg})
+		l.b.Queue.Push(RelayClose{Session: l.bs, Message: msg})
+	}
+}
+
+func (s *SocketController) closeRelaysOn(ctrl *ConnectionController) {
+	var ls []*relayLink
+	s.relayLock.Lock()
+	for k, l := range s.relays {
+		if k.con == ctrl.ConID && (l.a == ctrl || l.b == ctrl) {
+			ls = append(ls, l)
+		}
+	}
+	s.relayLock.Unlock()
+	for _, l := range ls {
+		s.closeRelayLink(l, "Relayed connection closed")
+	}
+}
+
+//findRelay a connection to a node we share with that can relay
+//for us.  If there are several one is picked at random, so a
+//node that refuses does not keep us from trying the others.
+func (s *SocketController) findRelay(target []byte) *ConnectionController {
+	myn, _ := s.DB.GetPrivateNodeData()
+	var r []*ConnectionController
+	for _, c := range s.listConnections() {
+		if _, ok := c.C.(*RelayConnection); ok {
+			continue
+		}
+		id := c.C.GetNodeID()
+		if !c.IsDone() && !bytes.Equal(id, target) && c.introducedFeature(CAPRELAY) && sharesWith(myn.ID, id, s.DB) {
+			r = append(r, c)
+		}
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	return r[rand.Intn(len(r))]
+}
+
+//connectThroughRelay reach a node that cannot be dialed
+func (s *SocketController) connectThroughRelay(e *gripdata.NodeEphemera) {
+	r := s.findRelay(e.ID)
+	if r == nil || !s.DB.CanNodeEphemeraGoPending(e.ID) {
+		return
+	}
+	f := e.ConnFailures
+	c := newRelayConnection(r, rand.Uint64(), e.ID)
+	if !r.addRelayEnd(c) || r.Queue.Push(RelayReq{Session: c.session, Target: e.ID}) != nil {
+		c.Close()
+		s.connectFailed(e.ID, f)
+		return
+	}
+	s.goRoutine(fmt.Sprintf("relay %d", c.session), func() {
+		s.relayHandshake(c, true, f)
+	})
+}
@@ -0,0 +1,214 @@
+package grip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wyathan/grip/gripdata"
+)
+
+//SEENCACHESIZE the most digests the seen cache remembers
+const SEENCACHESIZE int = 1 << 16
+
+//SEENPERDIG the most nodes remembered for each digest
+const SEENPERDIG int = 8
+
+//SeenCache remembers which nodes have a record, because they
+//sent it to us, offered it, or acknowledged it.  Records are not
+//offered to those nodes again.  The oldest digests are forgotten
+//first.
+type SeenCache struct {
+	sync.Mutex
+	max     int
+	nodes   map[string][][]byte
+	ring    []string //Digests in the order they were added
+	next    int
+	skipped uint64
+	db      Seendb
+}
+
+//NewSeenCache remembers at most max digests
+func NewSeenCache(max int) *SeenCache {
+	var c SeenCache
+	c.max = max
+	c.nodes = make(map[string][][]byte)
+	return &c
+}
+
+//seenDrop a digest, or one node for it, the cache forgot
+type seenDrop struct {
+	dig  []byte
+	node []byte
+}
+
+//Persist keeps what is seen in db, and loads what it kept before.
+//What does not fit in the cache is deleted.
+func (c *SeenCache) Persist(db Seendb) {
+	var dl []seenDrop
+	for _, s := range db.ListSeenDigs(c.max * SEENPERDIG) {
+		_, d := c.add(s.Dig, s.NodeID)
+		dl = append(dl, d...)
+	}
+	c.Lock()
+	c.db = db
+	c.Unlock()
+	for _, d := range dl {
+		err := db.DeleteSeenDig(d.dig, d.node)
+		if err != nil {
+			log.Printf("Failed to delete seen digest: %s", err)
+		}
+	}
+}
+
+//Add node has dig
+func (c *SeenCache) Add(dig []byte, node []byte) {
+	db, dl := c.add(dig, node)
+	if db == nil {
+		return
+	}
+	for _, d := range dl {
+		err := db.DeleteSeenDig(d.dig, d.node)
+		if err != nil {
+			log.Printf("Failed to delete seen digest: %s", err)
+		}
+	}
+	var s gripdata.SeenDig
+	s.Dig = dig
+	s.NodeID = node
+	s.Timestamp = uint64(time.Now().UnixNano())
+	err := db.StoreSeenDig(&s)
+	if err != nil {
+		log.Printf("Failed to store seen digest: %s", err)
+	}
+}
+
+//add returns where to keep it, nil if it was already known or
+//it is not kept, and what was forgotten to make room
+func (c *SeenCache) add(dig []byte, node []byte) (Seendb, []seenDrop) {
+	c.Lock()
+	defer c.Unlock()
+	if c.max <= 0 {
+		return nil, nil
+	}
+	k := base64.StdEncoding.EncodeToString(dig)
+	nl, ok := c.nodes[k]
+	for _, n := range nl {
+		if bytes.Equal(n, node) {
+			return nil, nil
+		}
+	}
+	var dl []seenDrop
+	if !ok {
+		if len(c.ring) < c.max {
+			c.ring = append(c.ring, k)
+		} else {
+			old := c.ring[c.next]
+			delete(c.nodes, old)
+			od, _ := base64.StdEncoding.DecodeString(old)
+			dl = append(dl, seenDrop{dig: od})
+			c.ring[c.next] = k
+			c.next = (c.next + 1) % c.max
+		}
+	}
+	if len(nl) >= SEENPERDIG {
+		dl = append(dl, seenDrop{dig: dig, node: nl[0]})
+		nl = nl[1:]
+	}
+	c.nodes[k] = append(nl, node)
+	return c.db, dl
+}
+
+//Has true if node is known to have dig
+func (c *SeenCache) Has(dig []byte, node []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, n := range c.nodes[base64.StdEncoding.EncodeToString(dig)] {
+		if bytes.Equal(n, node) {
+			return true
+		}
+	}
+	return false
+}
+
+//Forget node is missing dig after all
+func (c *SeenCache) Forget(dig []byte, node []byte) {
+	db := c.forget(dig, node)
+	if db == nil {
+		return
+	}
+	err := db.DeleteSeenDig(dig, node)
+	if err != nil {
+		log.Printf("Failed to delete seen digest: %s", err)
+	}
+}
+
+func (c *SeenCache) forget(dig []byte, node []byte) Seendb {
+	c.Lock()
+	defer c.Unlock()
+	k := base64.StdEncoding.EncodeToString(dig)
+	var nl [][]byte
+	for _, n := range c.nodes[k] {
+		if !bytes.Equal(n, node) {
+			nl = append(nl, n)
+		}
+	}
+	if _, ok := c.nodes[k]; ok {
+		//Keep the digest's place in the ring
+		c.nodes[k] = nl
+	}
+	return c.db
+}
+
+//Len the number of digests remembered
+func (c *SeenCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.nodes)
+}
+
+//Skipped the number of SendData dropped because the target
+//already had the record
+func (c *SeenCache) Skipped() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
+
+//seen the other node has dig
+func (ctrl *ConnectionController) seen(dig []byte) {
+	if ctrl.SocketCtrl != nil && ctrl.SocketCtrl.Seen != nil {
+		ctrl.SocketCtrl.Seen.Add(dig, ctrl.C.GetNodeID())
+	}
+}
+
+//unseen the other node told us it is missing dig
+func (ctrl *ConnectionController) unseen(dig []byte) {
+	if ctrl.SocketCtrl != nil && ctrl.SocketCtrl.Seen != nil {
+		ctrl.SocketCtrl.Seen.Forget(dig, ctrl.C.GetNodeID())
+	}
+}
+
+//skipSeen drops the SendData the other node already has, and
+//returns the rest
+func (ctrl *ConnectionController) skipSeen(sl []gripdata.SendData) []gripdata.SendData {
+	if ctrl.SocketCtrl == nil || ctrl.SocketCtrl.Seen == nil {
+		return sl
+	}
+	c := ctrl.SocketCtrl.Seen
+	id := ctrl.C.GetNodeID()
+	var r []gripdata.SendData
+	for _, v := range sl {
+		if !c.Has(v.Dig, id) {
+			r = append(r, v)
+			continue
+		}
+		_, err := ctrl.DB.DeleteSendData(v.Dig, id)
+		if err != nil {
+			log.Printf("Failed to delete SendData! %s", err)
+		}
+		atomic.AddUint64(&c.skipped, 1)
+	}
+	return r
+}
@@ -0,0 +1,139 @@
+package grip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wyathan/grip/griperrors"
+)
+
+//SendQueue is the outbound queue of a connection.  Only the write
+//routine takes from it.  Push never blocks.  PushWait waits a
+//bounded time for room, so the read routine stops reading from a
+//node that asks for more than it reads, but is not held up for
+//good by a write routine that is itself waiting on the other node.
+type SendQueue struct {
+	sync.Mutex
+	items     []interface{}
+	max       int
+	closed    bool
+	draining  bool
+	ready     chan bool
+	space     chan bool
+	done      chan bool
+	closeOnce sync.Once
+}
+
+//NewSendQueue a queue that holds up to max messages
+func NewSendQueue(max int) *SendQueue {
+	var q SendQueue
+	q.max = max
+	q.ready = make(chan bool, 1)
+	q.space = make(chan bool, 1)
+	q.done = make(chan bool)
+	return &q
+}
+
+//Push add d to the queue.  Fails if the queue is full or closed.
+func (q *SendQueue) Push(d interface{}) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return griperrors.ConnectionClosed
+	}
+	if len(q.items) >= q.max {
+		return griperrors.SendQueueFull
+	}
+	q.items = append(q.items, d)
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return nil
+}
+
+//PushWait add d to the queue, waiting up to timeout for room if
+//it is full.  Fails if there is still no room, or the queue closes.
+func (q *SendQueue) PushWait(d interface{}, timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		err := q.Push(d)
+		if err != griperrors.SendQueueFull {
+			return err
+		}
+		select {
+		case <-q.space:
+		case <-q.done:
+			return griperrors.ConnectionClosed
+		case <-t.C:
+			return griperrors.SendQueueFull
+		}
+	}
+}
+
+//Pop the oldest message, false if there is none
+func (q *SendQueue) Pop() (interface{}, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	d := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	select {
+	case q.space <- true:
+	default:
+	}
+	return d, true
+}
+
+//Len the number of messages waiting
+func (q *SendQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+//Ready gets a value after a Push.  Always Pop until empty
+//before waiting on it again.
+func (q *SendQueue) Ready() <-chan bool {
+	return q.ready
+}
+
+//Drain tells the write routine to close the connection once
+//the queue is empty
+func (q *SendQueue) Drain() {
+	q.Lock()
+	q.draining = true
+	q.Unlock()
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+//Draining true once Drain has been called
+func (q *SendQueue) Draining() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.draining
+}
+
+//Done is closed when the queue is closed
+func (q *SendQueue) Done() <-chan bool {
+	return q.done
+}
+
+//Close the queue, anything still in it is dropped.  Safe to
+//call more than once.
+func (q *SendQueue) Close() {
+	q.closeOnce.Do(func() {
+		q.Lock()
+		q.closed = true
+		q.items = nil
+		q.Unlock()
+		close(q.done)
+	})
+}
@@ -0,0 +1,105 @@
+package grip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+)
+
+//SESSIONKEYSIZE is the size of the AES-256 key used for
+//each direction of a connection
+const SESSIONKEYSIZE int = 32
+
+//sessionKey is a fresh key pair made for every connection and
+//thrown away after the handshake, so recorded traffic cannot be
+//read later even if a node key is stolen
+type sessionKey struct {
+	priv *ecdh.PrivateKey
+}
+
+func newSessionKey() (*sessionKey, error) {
+	p, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKey{priv: p}, nil
+}
+
+//Public the public half sent to the other node
+func (k *sessionKey) Public() []byte {
+	return k.priv.PublicKey().Bytes()
+}
+
+//ciphers derive the send and receive ciphers.  transcript must be
+//the same on both sides and cover everything that was signed in
+//the handshake.
+func (k *sessionKey) ciphers(peer []byte, transcript []byte, dialer bool) (*sessionCipher, *sessionCipher, error) {
+	pk, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := k.priv.ECDH(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	dk, err := newSessionCipher(secret, transcript, "grip dialer")
+	if err != nil {
+		return nil, nil, err
+	}
+	ak, err := newSessionCipher(secret, transcript, "grip acceptor")
+	if err != nil {
+		return nil, nil, err
+	}
+	if dialer {
+		return dk, ak, nil
+	}
+	return ak, dk, nil
+}
+
+//sessionCipher seals frames in one direction of a connection.
+//Nonces are a counter so a frame that is replayed, dropped or
+//moved is caught when it is opened.
+type sessionCipher struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newSessionCipher(secret []byte, salt []byte, info string) (*sessionCipher, error) {
+	k, err := hkdf.Key(sha512.New, secret, salt, info, SESSIONKEYSIZE)
+	if err != nil {
+		return nil, err
+	}
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCipher{aead: a}, nil
+}
+
+func (s *sessionCipher) nonce() []byte {
+	n := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], s.seq)
+	s.seq++
+	return n
+}
+
+func (s *sessionCipher) seal(b []byte) []byte {
+	return s.aead.Seal(nil, s.nonce(), b, nil)
+}
+
+func (s *sessionCipher) open(b []byte) ([]byte, error) {
+	p, err := s.aead.Open(nil, s.nonce(), b, nil)
+	if err != nil {
+		return nil, errors.New("Failed to decrypt frame")
+	}
+	return p, nil
+}
@@ -1,23 +1,52 @@
 package grip
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/orcaman/concurrent-map"
+	"github.com/wyathan/grip/griperrors"
 )
 
 //SocketController handles a socket
 type SocketController struct {
 	sync.Mutex
-	Connections map[string]*ConnectionController
-	S           Socket
-	Done        bool
-	DB          DB
-	LastLoop    uint64
+	Connections  map[string]*ConnectionController
+	S            Socket
+	done         int32 //1 once closed, use IsDone
+	DB           DB
+	LastLoop     uint64          //When the connect routine last looped, use atomic
+	PingInterval time.Duration   //Set before Start
+	PeerTimeout  time.Duration   //Set before Start
+	Relay        *RelayLimits    //Set before Start to relay for other nodes
+	Discovery    *Discovery      //Set before Start to find nodes on the local network
+	Bandwidth    BandwidthLimits //Set before Start
+	SyncInterval time.Duration   //Set before Start, zero to never compare contexts
+	Orphans      *OrphanPool     //Records waiting for a record they need
+	RejectRetry  time.Duration   //Set before Start, zero to never send rejected data again
+	MaxRetries   uint32          //Set before Start
+	Seen         *SeenCache      //Set before Start, nil to offer every record
+	downloads    map[string]bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closing      chan bool //Closed when we stop making connections
+	routines     sync.WaitGroup
+	running      map[string]bool //Names of the routines still running
+	runLock      sync.Mutex
+	relays       map[relayKey]*relayLink
+	relayLock    sync.Mutex
+	sent         *RateLimit
+	fileSent     *RateLimit
+	accountSent  map[string]*RateLimit
+	rateLock     sync.Mutex
 }
 
 //NewSocketController builds a new SocketController to handle
@@ -27,6 +56,18 @@ func NewSocketController(sock Socket, db DB) *SocketController {
 	s.S = sock
 	s.DB = db
 	s.Connections = make(map[string]*ConnectionController)
+	s.downloads = make(map[string]bool)
+	s.closing = make(chan bool)
+	s.running = make(map[string]bool)
+	s.relays = make(map[relayKey]*relayLink)
+	s.accountSent = make(map[string]*RateLimit)
+	s.PingInterval = PINGINTERVAL
+	s.PeerTimeout = PEERTIMEOUT
+	s.SyncInterval = SYNCINTERVAL
+	s.Orphans = NewOrphanPool()
+	s.RejectRetry = REJECTRETRY
+	s.MaxRetries = MAXREJECTRETRIES
+	s.Seen = NewSeenCache(SEENCACHESIZE)
 	return &s
 }
 func (s *SocketController) checkEphemera(mstr string) {
@@ -45,42 +86,67 @@ func (s *SocketController) checkConnections() {
 	mid, _ := s.DB.GetPrivateNodeData()
 	mstr := base64.StdEncoding.EncodeToString(mid.ID)
 	for k, con := range s.Connections {
-		if con.Done {
+		if con.IsDone() {
 			log.Printf("ERROR: Connection done, but still connected me: %s, from: %s", mstr, k)
 		}
 	}
 	s.checkEphemera(mstr)
 }
 
+//dialedByLower true if c was dialed by whichever of the two
+//nodes has the lower ID
+func (s *SocketController) dialedByLower(c *ConnectionController) bool {
+	myn, _ := s.DB.GetPrivateNodeData()
+	lower := bytes.Compare(myn.ID, c.C.GetNodeID()) < 0
+	return lower != c.Incoming
+}
+
+//keepNew decides which of two connections to the same node to
+//keep.  When both nodes dial each other at once, each keeps the
+//one dialed by the node with the lower ID.  Both nodes come to
+//the same answer without having to ask each other.  If the same
+//node dialed both, it gave up on the old one, so the new one is kept.
+func (s *SocketController) keepNew(c *ConnectionController, old *ConnectionController) bool {
+	if c.Incoming == old.Incoming {
+		return true
+	}
+	return s.dialedByLower(c)
+}
+
 func (s *SocketController) addConnection(c *ConnectionController) bool {
+	//NOTE00 The SocketCtrl is set even if the connection is
+	//closed.  removeConnection only removes the connection it is
+	//given, so the one we keep stays in the Connections map.
+	c.SocketCtrl = s
 	s.Lock()
-	defer s.Unlock()
-	if len(s.Connections) >= MAXCONNECTIONS {
-		c.SocketCtrl = nil
+	if s.IsDone() || len(s.Connections) >= MAXCONNECTIONS {
+		s.Unlock()
 		c.Close()
 		return false
 	}
 	ck := base64.StdEncoding.EncodeToString(c.C.GetNodeID())
 	cc := s.Connections[ck]
-	if cc != nil {
-		//NOTE00 This is important otherwise the existing connection
-		//may be removed from the Connections map when this
-		//one is closed
-		c.SocketCtrl = nil
+	if cc != nil && !s.keepNew(c, cc) {
+		s.Unlock()
 		c.Close()
 		return false
 	}
-	c.SocketCtrl = s
 	log.Printf("ADDCON!")
 	s.Connections[ck] = c
+	s.Unlock()
+	if cc != nil {
+		cc.Close()
+	}
 	return true
 }
-func (s *SocketController) removeConnection(id []byte) {
+func (s *SocketController) removeConnection(c *ConnectionController) {
 	s.Lock()
 	defer s.Unlock()
-	ck := base64.StdEncoding.EncodeToString(id)
-	log.Printf("DELETE")
-	delete(s.Connections, ck)
+	ck := base64.StdEncoding.EncodeToString(c.C.GetNodeID())
+	if s.Connections[ck] == c {
+		log.Printf("DELETE")
+		delete(s.Connections, ck)
+	}
 }
 func (s *SocketController) checkConnection(id []byte) bool {
 	s.Lock()
@@ -88,6 +154,22 @@ func (s *SocketController) checkConnection(id []byte) bool {
 	ck := base64.StdEncoding.EncodeToString(id)
 	return nil != s.Connections[ck]
 }
+
+//claimDownload only one connection may write to a part file
+func (s *SocketController) claimDownload(p string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.downloads[p] {
+		return false
+	}
+	s.downloads[p] = true
+	return true
+}
+func (s *SocketController) releaseDownload(p string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.downloads, p)
+}
 func (s *SocketController) numberConnections() int {
 	s.Lock()
 	defer s.Unlock()
@@ -110,16 +192,95 @@ func (s *SocketController) Close() {
 		s.closeAllConnections()
 		s.S.Close()
 	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+//Shutdown stops the node gracefully.  No new connections are
+//made, and each connection sends what it has queued, like Acks
+//for data just stored, before it closes.  If ctx ends first the
+//connections are closed as they are, and ShutdownTimeout is
+//returned once the routines still running have been logged.
+func (s *SocketController) Shutdown(ctx context.Context) error {
+	if s.closeGate() {
+		s.S.Close()
+		for _, c := range s.listConnections() {
+			c.drain()
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		s.routines.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Close()
+		log.Printf("Routines still running after shutdown: %v", s.RunningRoutines())
+		return griperrors.ShutdownTimeout
+	}
+	s.Close()
+	return nil
+}
+
+//IsDone the socket controller has been closed
+func (s *SocketController) IsDone() bool {
+	return atomic.LoadInt32(&s.done) == 1
 }
+
 func (s *SocketController) closeGate() bool {
 	s.Lock()
 	defer s.Unlock()
-	if !s.Done {
-		s.Done = true
+	if !s.IsDone() {
+		atomic.StoreInt32(&s.done, 1)
+		close(s.closing)
 		return true
 	}
 	return false
 }
+
+//sleep false if we stopped making connections first
+func (s *SocketController) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.closing:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+//goRoutine runs f in a routine that Shutdown waits for
+func (s *SocketController) goRoutine(name string, f func()) {
+	s.routines.Add(1)
+	s.runLock.Lock()
+	s.running[name] = true
+	s.runLock.Unlock()
+	go func() {
+		defer s.routines.Done()
+		defer func() {
+			s.runLock.Lock()
+			delete(s.running, name)
+			s.runLock.Unlock()
+		}()
+		f()
+	}()
+}
+
+//RunningRoutines the names of the routines still running
+func (s *SocketController) RunningRoutines() []string {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	var r []string
+	for k := range s.running {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return r
+}
 func (s *SocketController) closeAllConnections() {
 	cl := s.listConnections()
 	for _, c := range cl {
@@ -127,13 +288,27 @@ func (s *SocketController) closeAllConnections() {
 	}
 }
 
-//Start begin the goroutines for the SocketController
-func (s *SocketController) Start() {
+//Start begin the goroutines for the SocketController.  They
+//all stop, and every connection is closed, when ctx is done.
+func (s *SocketController) Start(ctx context.Context) {
 	//We're just starting.  We can't be
 	//connected to any node
 	s.DB.ClearAllConnected()
-	go s.listenRoutine()
-	go s.connectRoutine()
+	s.startLimits()
+	if sd, ok := s.DB.(Seendb); ok && s.Seen != nil {
+		s.Seen.Persist(sd)
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	context.AfterFunc(s.ctx, s.Close)
+	s.goRoutine("listen", s.listenRoutine)
+	s.goRoutine("connect", s.connectRoutine)
+	s.goRoutine("supervise", s.superviseRoutine)
+	if s.Discovery != nil {
+		s.goRoutine("discover", s.discoverRoutine)
+	}
+	if s.RejectRetry > 0 {
+		s.goRoutine("retry", s.retryRoutine)
+	}
 }
 
 func (s *SocketController) buildConnectionController(con Connection, incomming bool) {
@@ -141,28 +316,38 @@ func (s *SocketController) buildConnectionController(con Connection, incomming b
 	ctrl.C = con
 	ctrl.DB = s.DB
 	ctrl.Incoming = incomming
-	ctrl.SendChan = make(chan interface{}, BUFFERSIZE)
+	ctrl.Queue = NewSendQueue(MAXQUEUE)
 	ctrl.Pending = cmap.New()
+	ctrl.Introduced = make(chan bool)
+	ctrl.downloads = make(map[string]*fileDownload)
+	ctrl.relayEnds = make(map[uint64]*RelayConnection)
+	ctrl.mail = newMailState()
+	ctrl.digs = newDigBatch()
+	ctrl.setLimits(s)
 	ctrl.ConID = rand.Uint64()
+	ctrl.readLoopDone()
+	ctrl.writeLoopDone()
 	s.addConnection(&ctrl)
-	go ctrl.ConnectionReadRoutine()
-	go ctrl.ConnectionWriteRoutine()
+	stop := context.AfterFunc(s.ctx, ctrl.Close)
+	s.goRoutine(fmt.Sprintf("read %d", ctrl.ConID), ctrl.ConnectionReadRoutine)
+	s.goRoutine(fmt.Sprintf("write %d", ctrl.ConID), func() {
+		defer stop()
+		ctrl.ConnectionWriteRoutine()
+	})
 }
 
 func (s *SocketController) listenRoutine() {
 	con, err := s.S.Accept()
-	for !s.Done && err == nil {
+	for !s.IsDone() && err == nil {
 		if con.GetNodeID() == nil {
 			log.Printf("This is bad.  Connections should only return with valid ID")
 		} else {
-			if s.DB.CanNodeEphemeraGoPending(con.GetNodeID()) {
-				s.buildConnectionController(con, true)
-			} else {
-				con.Close()
-				s.DB.SetNodeEphemeraClosed(con.GetNodeID())
-			}
+			//Even if we are connecting, or connected, to the
+			//node, addConnection decides which connection to keep.
+			//This still creates the Node Ephemera for a new node.
+			s.DB.CanNodeEphemeraGoPending(con.GetNodeID())
+			s.buildConnectionController(con, true)
 		}
 		con, err = s.S.Accept()
-		s.LastLoop = uint64(time.Now().UnixNano())
 	}
 }
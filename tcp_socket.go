@@ -0,0 +1,145 @@
+package grip
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wyathan/grip/gripdata"
+)
+
+//DIALTIMEOUT how long to wait for a tcp connection to
+//be established
+const DIALTIMEOUT time.Duration = 10 * time.Second
+
+//TCPSocket accepts and makes tcp connections to other nodes
+type TCPSocket struct {
+	Listener  net.Listener
+	DB        Nodedb
+	accepted  chan Connection
+	done      chan bool
+	closeOnce sync.Once
+}
+
+//NewTCPSocket listens on this node's BindAddress and BindPort
+func NewTCPSocket(db Nodedb) (*TCPSocket, error) {
+	_, pr := db.GetPrivateNodeData()
+	if pr == nil {
+		return nil, errors.New("Private node data not found")
+	}
+	addr := net.JoinHostPort(pr.BindAddress, strconv.Itoa(int(pr.BindPort)))
+	return ListenTCP(addr, db)
+}
+
+//ListenTCP listens on addr.  The local node data is only
+//needed once connections are made, so a new node can find
+//out its address before it is created and signed.
+func ListenTCP(addr string, db Nodedb) (*TCPSocket, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var s TCPSocket
+	s.Listener = l
+	s.DB = db
+	s.accepted = make(chan Connection)
+	s.done = make(chan bool)
+	go s.acceptRoutine()
+	return &s, nil
+}
+
+//Addr the address we are listening on
+func (s *TCPSocket) Addr() net.Addr {
+	return s.Listener.Addr()
+}
+
+func (s *TCPSocket) acceptRoutine() {
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("Accept error: %s", err)
+			time.Sleep(CONNECTROUTINESLEEP)
+			continue
+		}
+		//Identify in another routine so a slow node
+		//does not keep us from accepting others
+		go s.acceptConnection(c)
+	}
+}
+
+func (s *TCPSocket) acceptConnection(c net.Conn) {
+	con, err := NewNetConnection(c, nil, s.DB)
+	if err != nil {
+		log.Printf("Incoming connection failed: %s", err)
+		return
+	}
+	select {
+	case s.accepted <- con:
+	case <-s.done:
+		con.Close()
+	}
+}
+
+//Accept returns the next identified incoming connection
+func (s *TCPSocket) Accept() (Connection, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.done:
+		return nil, errors.New("Socket closed")
+	}
+}
+
+//ConnectTo dials the node's addresses in order until one
+//works, and remembers which one did.  All the dials and the
+//handshake share one deadline, however many addresses there are.
+func (s *TCPSocket) ConnectTo(n *gripdata.Node) (Connection, error) {
+	if n == nil {
+		return nil, errors.New("Unknown node")
+	}
+	ul := NodeURLs(n)
+	if len(ul) == 0 {
+		return nil, errors.New("Node has no URL")
+	}
+	var err error
+	dl := time.Now().Add(DIALTIMEOUT + HANDSHAKETIMEOUT)
+	d := net.Dialer{Timeout: DIALTIMEOUT, Deadline: dl}
+	for _, u := range ul {
+		var c net.Conn
+		c, err = d.Dial("tcp", TCPAddress(u))
+		if err != nil {
+			continue
+		}
+		var con Connection
+		//Another node may have the address now
+		con, err = newNetConnection(c, n.ID, s.DB, dl)
+		if err != nil {
+			continue
+		}
+		s.DB.SetNodeEphemeraAddress(n.ID, u)
+		return con, nil
+	}
+	return nil, err
+}
+
+//Close stop listening
+func (s *TCPSocket) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Listener.Close()
+	})
+}
+
+//TCPAddress get the host:port from a node URL
+func TCPAddress(url string) string {
+	return strings.TrimPrefix(url, "tcp://")
+}
@@ -0,0 +1,99 @@
+package grip
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/wyathan/grip/gripdata"
+	"github.com/wyathan/grip/griperrors"
+)
+
+//MAXFRAMESIZE is the largest frame we will accept from
+//a stream connection
+const MAXFRAMESIZE int = 16 * 1024 * 1024
+
+//FRAMEHEADERSIZE is the number of bytes used for the
+//length of each frame
+const FRAMEHEADERSIZE int = 4
+
+func init() {
+	registerWireTypes()
+}
+
+//registerWireTypes every type handled by readSwitch must be
+//registered here so it can cross a stream connection.  Protocol
+//messages use tags below 100 and gripdata records 100 and up.
+func registerWireTypes() {
+	RegisterWireType(1, "HandshakeHello", HandshakeHello{})
+	RegisterWireType(2, "HandshakeProof", HandshakeProof{})
+	RegisterWireType(3, "CheckDig", CheckDig{})
+	RegisterWireType(4, "RespDig", RespDig{})
+	RegisterWireType(5, "SendDig", SendDig{})
+	RegisterWireType(6, "RejectDig", RejectDig{})
+	RegisterWireType(7, "AckDig", AckDig{})
+	RegisterWireType(8, "ReqContextFile", ReqContextFile{})
+	RegisterWireType(9, "Introduction", Introduction{})
+	RegisterWireType(10, "FileChunkReq", FileChunkReq{})
+	RegisterWireType(11, "FileChunk", FileChunk{})
+	RegisterWireType(12, "Ping", Ping{})
+	RegisterWireType(13, "Pong", Pong{})
+	RegisterWireType(14, "RelayReq", RelayReq{})
+	RegisterWireType(15, "RelayOpen", RelayOpen{})
+	RegisterWireType(16, "RelayData", RelayData{})
+	RegisterWireType(17, "RelayClose", RelayClose{})
+	RegisterWireType(18, "MailOffer", MailOffer{})
+	RegisterWireType(19, "MailResp", MailResp{})
+	RegisterWireType(20, "MailDeposit", MailDeposit{})
+	RegisterWireType(21, "MailItem", MailItem{})
+	RegisterWireType(22, "MailAck", MailAck{})
+	RegisterWireType(23, "MailReceipt", MailReceipt{})
+	RegisterWireType(24, "DiscoveryAnnounce", DiscoveryAnnounce{})
+	RegisterWireType(25, "Compressed", Compressed{})
+	RegisterWireType(26, "CheckDigs", CheckDigs{})
+	RegisterWireType(27, "RespDigs", RespDigs{})
+	RegisterWireType(28, "AckDigs", AckDigs{})
+	RegisterWireType(29, "SyncRoot", SyncRoot{})
+	RegisterWireType(30, "SyncBuckets", SyncBuckets{})
+	RegisterWireType(31, "SyncDigs", SyncDigs{})
+	RegisterWireType(32, "SyncWant", SyncWant{})
+	RegisterWireType(100, "Node", &gripdata.Node{})
+	RegisterWireType(101, "AssociateNodeAccountKey", &gripdata.AssociateNodeAccountKey{})
+	RegisterWireType(102, "UseShareNodeKey", &gripdata.UseShareNodeKey{})
+	RegisterWireType(103, "ShareNodeInfo", &gripdata.ShareNodeInfo{})
+	RegisterWireType(104, "Context", &gripdata.Context{})
+	RegisterWireType(105, "ContextRequest", &gripdata.ContextRequest{})
+	RegisterWireType(106, "ContextResponse", &gripdata.ContextResponse{})
+	RegisterWireType(107, "ContextFile", &gripdata.ContextFile{})
+	RegisterWireType(108, "ContextFileTransfer", &gripdata.ContextFileTransfer{})
+}
+
+//WriteFrame writes b with its length in front
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MAXFRAMESIZE {
+		return griperrors.FrameTooLarge
+	}
+	f := make([]byte, FRAMEHEADERSIZE+len(b))
+	binary.BigEndian.PutUint32(f, uint32(len(b)))
+	copy(f[FRAMEHEADERSIZE:], b)
+	_, err := w.Write(f)
+	return err
+}
+
+//ReadFrame reads one frame written by WriteFrame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	h := make([]byte, FRAMEHEADERSIZE)
+	_, err := io.ReadFull(r, h)
+	if err != nil {
+		return nil, err
+	}
+	l := int(binary.BigEndian.Uint32(h))
+	if l > MAXFRAMESIZE {
+		return nil, griperrors.FrameTooLarge
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}